@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"sync"
+)
+
+// backgroundTasks runs tasks in the background, a bounded number at a time, such as promotions by TieredClient and
+// shadow reads by MirrorClient.
+type backgroundTasks struct {
+	// ctx is canceled by flush to abort the pending tasks
+	ctx     context.Context
+	cancel  context.CancelFunc
+	pending sync.WaitGroup
+	sem     chan struct{}
+}
+
+func newBackgroundTasks(maxConcurrent int) *backgroundTasks {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &backgroundTasks{ctx: ctx, cancel: cancel, sem: make(chan struct{}, maxConcurrent)}
+}
+
+// run calls task in a goroutine once fewer than maxConcurrent tasks are running. task should give up when ctx is
+// done. Once the tasks are aborted, those still waiting for their turn are called right away, so that they can
+// clean up.
+func (b *backgroundTasks) run(task func(ctx context.Context)) {
+	b.pending.Add(1)
+	go func() {
+		defer b.pending.Done()
+
+		select {
+		case b.sem <- struct{}{}:
+			defer func() { <-b.sem }()
+		case <-b.ctx.Done():
+		}
+		task(b.ctx)
+	}()
+}
+
+// flush waits for the pending tasks to finish. If ctx is done first, they are aborted.
+func (b *backgroundTasks) flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		b.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		b.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
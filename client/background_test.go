@@ -0,0 +1,58 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestBackgroundTasks(t *testing.T) {
+	t.Run("flush waits for the tasks", func(t *testing.T) {
+		var (
+			tasks                  = newBackgroundTasks(2)
+			mu                     sync.Mutex
+			done, running, maxSeen int
+		)
+		for i := 0; i < 10; i++ {
+			tasks.run(func(ctx context.Context) {
+				mu.Lock()
+				running++
+				maxSeen = max(maxSeen, running)
+				mu.Unlock()
+
+				time.Sleep(time.Millisecond)
+
+				mu.Lock()
+				running--
+				done++
+				mu.Unlock()
+			})
+		}
+		assert.NilError(t, tasks.flush(context.Background()))
+		assert.Equal(t, done, 10)
+		assert.Assert(t, maxSeen <= 2, maxSeen)
+	})
+
+	t.Run("flush aborts the tasks once ctx is done", func(t *testing.T) {
+		var (
+			tasks   = newBackgroundTasks(1)
+			aborted atomic.Int32
+		)
+		for i := 0; i < 3; i++ {
+			tasks.run(func(ctx context.Context) {
+				<-ctx.Done()
+				aborted.Add(1)
+			})
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.ErrorIs(t, tasks.flush(ctx), context.Canceled)
+		// the waiting tasks are called too, so that they can clean up
+		assert.Equal(t, aborted.Load(), int32(3))
+	})
+}
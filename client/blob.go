@@ -0,0 +1,114 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/Southclaws/fault"
+	"github.com/Southclaws/fault/fmsg"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// ErrDigestMismatch is returned when uploaded content doesn't match its expected digest.
+var ErrDigestMismatch = errors.New("content does not match the digest")
+
+// maxInMemorySpool is the largest upload of a known size that is spooled to memory instead of a temp file.
+const maxInMemorySpool = 4 * 1024 * 1024
+
+// spool reads r to the end, hashing it on the fly, so that the content can be sent once its digest is known.
+// Small uploads are kept in memory, larger ones go to a temp file. cleanup must be called when the returned
+// reader is no longer needed.
+func spool(r io.Reader, size int64) (rdr io.Reader, d *remoteexecution.Digest, cleanup func(), err error) {
+	var (
+		h = sha256.New()
+		n int64
+	)
+	cleanup = func() {}
+
+	if size >= 0 && size <= maxInMemorySpool {
+		buf := bytes.NewBuffer(make([]byte, 0, size))
+		if n, err = io.Copy(io.MultiWriter(buf, h), r); err != nil {
+			err = fault.Wrap(err, fmsg.With("error reading upload"))
+			return
+		}
+		rdr = buf
+	} else {
+		var f *os.File
+		if f, err = os.CreateTemp("", "tbc-upload-*.tmp"); err != nil {
+			err = fault.Wrap(err, fmsg.With("error creating a temp file"))
+			return
+		}
+		cleanup = func() {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+		if n, err = io.Copy(io.MultiWriter(f, h), r); err != nil {
+			err = fault.Wrap(err, fmsg.With("error spooling upload"))
+			return
+		}
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			err = fault.Wrap(err, fmsg.With("error seeking file"))
+			return
+		}
+		rdr = f
+	}
+
+	if size >= 0 && n != size {
+		err = fault.New(fmt.Sprintf("expected %d bytes, got %d", size, n))
+		return
+	}
+	d = newDigest(h, n)
+	return
+}
+
+// digestFile hashes f and rewinds it.
+func digestFile(f *os.File) (*remoteexecution.Digest, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, fault.Wrap(err, fmsg.With("error hashing file"))
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, fault.Wrap(err, fmsg.With("error seeking file"))
+	}
+	return newDigest(h, n), nil
+}
+
+func newDigest(h hash.Hash, size int64) *remoteexecution.Digest {
+	return &remoteexecution.Digest{
+		Hash:      fmt.Sprintf("%x", h.Sum(nil)),
+		SizeBytes: size,
+	}
+}
+
+// digestVerifier passes the content of r through, hashing it on the fly. Instead of io.EOF, it returns an error
+// if the content does not match the expected digest.
+type digestVerifier struct {
+	r        io.Reader
+	h        hash.Hash
+	n        int64
+	expected *remoteexecution.Digest
+}
+
+func newDigestVerifier(r io.Reader, expected *remoteexecution.Digest) *digestVerifier {
+	return &digestVerifier{r: r, h: sha256.New(), expected: expected}
+}
+
+func (v *digestVerifier) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	v.n += int64(n)
+
+	if err == io.EOF {
+		if actual := newDigest(v.h, v.n); actual.Hash != v.expected.GetHash() || actual.SizeBytes != v.expected.GetSizeBytes() {
+			return n, fault.Wrap(ErrDigestMismatch, fmsg.With(fmt.Sprintf("content digest %s/%d does not match the expected %s/%d",
+				actual.Hash, actual.SizeBytes, v.expected.GetHash(), v.expected.GetSizeBytes())))
+		}
+	}
+	return n, err
+}
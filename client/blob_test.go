@@ -0,0 +1,62 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"gotest.tools/v3/assert"
+)
+
+func TestSpool(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		n     int
+		size  int64
+		inMem bool
+	}{
+		{"small known size", 100, 100, true},
+		{"small unknown size", 100, UnknownSize, false},
+		{"large known size", maxInMemorySpool + 1, maxInMemorySpool + 1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			content := bytes.Repeat([]byte{'x'}, tc.n)
+
+			rdr, d, cleanup, err := spool(bytes.NewReader(content), tc.size)
+			defer cleanup()
+			assert.NilError(t, err)
+
+			_, isFile := rdr.(*os.File)
+			assert.Equal(t, isFile, !tc.inMem)
+			assert.Equal(t, d.GetHash(), fmt.Sprintf("%x", sha256.Sum256(content)))
+			assert.Equal(t, d.GetSizeBytes(), int64(tc.n))
+
+			spooled, err := io.ReadAll(rdr)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, spooled, content)
+		})
+	}
+
+	t.Run("size mismatch", func(t *testing.T) {
+		_, _, cleanup, err := spool(bytes.NewReader([]byte("short")), 10)
+		defer cleanup()
+		assert.ErrorContains(t, err, "expected 10 bytes, got 5")
+	})
+}
+
+func TestDigestVerifier(t *testing.T) {
+	content := []byte("content")
+	d := &remoteexecution.Digest{Hash: fmt.Sprintf("%x", sha256.Sum256(content)), SizeBytes: int64(len(content))}
+
+	data, err := io.ReadAll(newDigestVerifier(bytes.NewReader(content), d))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, data, content)
+
+	_, err = io.ReadAll(newDigestVerifier(bytes.NewReader([]byte("tampered")), d))
+	assert.ErrorContains(t, err, "does not match the expected")
+	assert.ErrorIs(t, err, ErrDigestMismatch)
+}
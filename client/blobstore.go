@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"io"
+
+	"github.com/Southclaws/fault"
+	"github.com/Southclaws/fault/fctx"
+	"github.com/Southclaws/fault/fmsg"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/grpc"
+)
+
+// BlobStore gives direct access to the action cache and CAS of the remote cache, bypassing the key mapping
+// of Interface. Blobs are addressed by the hex-encoded SHA256 of their content and their size.
+type BlobStore interface {
+	// GetActionResult returns the action result of the action with the given hash. Returns a NotFound status
+	// error if there is none.
+	GetActionResult(ctx context.Context, hash string) (*remoteexecution.ActionResult, error)
+	UpdateActionResult(ctx context.Context, hash string, ar *remoteexecution.ActionResult) error
+	FindBlob(ctx context.Context, hash string, size int64) (bool, error)
+	// ReadBlob writes the blob to w. Returns a NotFound status error if there is none.
+	ReadBlob(ctx context.Context, hash string, size int64, w io.Writer) error
+	// WriteBlob stores the content read from r, which may be of UnknownSize. Returns ErrDigestMismatch if the
+	// content doesn't match hash and size.
+	WriteBlob(ctx context.Context, hash string, size int64, r io.Reader) error
+}
+
+var _ BlobStore = (*client)(nil)
+
+// NewBlobStore instantiates a BlobStore for a remote cache.
+func NewBlobStore(cc *grpc.ClientConn) BlobStore {
+	return newClient(cc)
+}
+
+// The action digests sent by GetActionResult and UpdateActionResult have a size of 0: the size of the action isn't
+// known to callers that only have the hash (e.g. the Bazel HTTP cache protocol). Common servers such as
+// bazel-remote key the action cache by the hash only. A server that also checks the size reports every action
+// result as missing and rejects the updates, so the Bazel HTTP cache works like an empty one, and the builds just
+// don't get cache hits.
+
+func (c *client) GetActionResult(ctx context.Context, hash string) (*remoteexecution.ActionResult, error) {
+	ar, err := c.ac.GetActionResult(ctx, &remoteexecution.GetActionResultRequest{
+		ActionDigest: &remoteexecution.Digest{Hash: hash},
+	})
+	return ar, fault.Wrap(err, fmsg.With("GetActionResult failed"), fctx.With(ctx))
+}
+
+func (c *client) UpdateActionResult(ctx context.Context, hash string, ar *remoteexecution.ActionResult) error {
+	_, err := c.ac.UpdateActionResult(ctx, &remoteexecution.UpdateActionResultRequest{
+		ActionDigest: &remoteexecution.Digest{Hash: hash},
+		ActionResult: ar,
+	})
+	return fault.Wrap(err, fmsg.With("UpdateActionResult failed"), fctx.With(ctx))
+}
+
+func (c *client) FindBlob(ctx context.Context, hash string, size int64) (bool, error) {
+	resp, err := c.cas.FindMissingBlobs(ctx, &remoteexecution.FindMissingBlobsRequest{
+		BlobDigests: []*remoteexecution.Digest{{Hash: hash, SizeBytes: size}},
+	})
+	if err != nil {
+		return false, fault.Wrap(err, fmsg.With("FindMissingBlobs failed"), fctx.With(ctx))
+	}
+	return len(resp.GetMissingBlobDigests()) == 0, nil
+}
+
+func (c *client) ReadBlob(ctx context.Context, hash string, size int64, w io.Writer) error {
+	rdr, err := c.bs.NewReader(ctx, getDownloadResourceName(&remoteexecution.Digest{Hash: hash, SizeBytes: size}))
+	if err != nil {
+		return fault.Wrap(err, fmsg.With("NewReader failed"), fctx.With(ctx))
+	}
+	defer func() { _ = rdr.Close() }()
+
+	if _, err = io.Copy(w, rdr); err != nil {
+		return fault.Wrap(err, fmsg.With("fetching from bytestream client failed"), fctx.With(ctx))
+	}
+	return nil
+}
+
+func (c *client) WriteBlob(ctx context.Context, hash string, size int64, r io.Reader) error {
+	d := &remoteexecution.Digest{Hash: hash, SizeBytes: size}
+	if size < 0 {
+		rdr, actual, cleanup, err := spool(r, size)
+		defer cleanup()
+		if err != nil {
+			return fault.Wrap(err, fctx.With(ctx))
+		}
+		if actual.GetHash() != hash {
+			return fault.Wrap(ErrDigestMismatch, fctx.With(ctx))
+		}
+		d, r = actual, rdr
+	} else {
+		r = newDigestVerifier(r, d)
+	}
+
+	return fault.Wrap(c.uploadToCAS(ctx, r, d), fmsg.With("CAS upload failed"), fctx.With(ctx))
+}
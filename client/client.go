@@ -15,8 +15,6 @@ import (
 	"github.com/google/uuid"
 	"google.golang.org/api/transport/bytestream"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/prototext"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
@@ -35,6 +33,10 @@ var _ Interface = (*client)(nil)
 
 // NewClient instantiates a client for a remote cache.
 func NewClient(cc *grpc.ClientConn) Interface {
+	return newClient(cc)
+}
+
+func newClient(cc *grpc.ClientConn) *client {
 	return &client{
 		cap: remoteexecution.NewCapabilitiesClient(cc),
 		cas: remoteexecution.NewContentAddressableStorageClient(cc),
@@ -74,8 +76,35 @@ func (c *client) UploadFile(ctx context.Context, key, filePath string, metadata
 	}
 	defer func() { _ = f.Close() }()
 
-	fileDigest, err := c.uploadToCAS(ctx, f)
+	fileDigest, err := digestFile(f)
 	if err != nil {
+		return fault.Wrap(err, fctx.With(ctx))
+	}
+
+	return c.upload(ctx, key, f, fileDigest, metadata)
+}
+
+// UploadReader uploads the content read from r to the remote cache so that it can be referenced by
+// the provided key. If both size and digest are known, the content is streamed to CAS directly and verified
+// on the fly. Otherwise, it has to be spooled first, because ByteStream upload requires the digest up front.
+func (c *client) UploadReader(ctx context.Context, key string, r io.Reader, size int64, digest string, metadata Metadata) error {
+	if size < 0 || digest == "" {
+		rdr, d, cleanup, err := spool(r, size)
+		defer cleanup()
+		if err != nil {
+			return fault.Wrap(err, fctx.With(ctx))
+		}
+		return c.upload(ctx, key, rdr, d, metadata)
+	}
+
+	d := &remoteexecution.Digest{Hash: digest, SizeBytes: size}
+	return c.upload(ctx, key, newDigestVerifier(r, d), d, metadata)
+}
+
+// upload stores the content of r (which must match fileDigest) in CAS and creates an action result
+// referencing it.
+func (c *client) upload(ctx context.Context, key string, r io.Reader, fileDigest *remoteexecution.Digest, metadata Metadata) error {
+	if err := c.uploadToCAS(ctx, r, fileDigest); err != nil {
 		return fault.Wrap(err, fmsg.With("CAS upload failed"), fctx.With(ctx))
 	}
 
@@ -102,68 +131,66 @@ func (c *client) UploadFile(ctx context.Context, key, filePath string, metadata
 		}
 	}
 
+	ar, err := newActionResult(fileDigest, metadata)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.ac.UpdateActionResult(ctx, &remoteexecution.UpdateActionResultRequest{
+		ActionDigest: acProtos.action.digest,
+		ActionResult: ar,
+	})
+	return fault.Wrap(err, fmsg.With("UpdateActionResult failed"), fctx.With(ctx))
+}
+
+// newActionResult creates an action result pretending to have generated the artifact with fileDigest.
+func newActionResult(fileDigest *remoteexecution.Digest, metadata Metadata) (*remoteexecution.ActionResult, error) {
 	var eam *remoteexecution.ExecutedActionMetadata
 	if len(metadata) > 0 {
-		var protoMd []*anypb.Any
-		protoMd, err = convertMetadataToProto(metadata)
+		protoMd, err := convertMetadataToProto(metadata)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		eam = &remoteexecution.ExecutedActionMetadata{
 			AuxiliaryMetadata: protoMd,
 		}
 	}
 
-	_, err = c.ac.UpdateActionResult(ctx, &remoteexecution.UpdateActionResultRequest{
-		ActionDigest: acProtos.action.digest,
-		ActionResult: &remoteexecution.ActionResult{
-			OutputFiles: []*remoteexecution.OutputFile{
-				{
-					Path:   blobFileName,
-					Digest: fileDigest,
-				},
+	return &remoteexecution.ActionResult{
+		OutputFiles: []*remoteexecution.OutputFile{
+			{
+				Path:   blobFileName,
+				Digest: fileDigest,
 			},
-			ExecutionMetadata: eam,
 		},
-	})
-	return fault.Wrap(err, fmsg.With("UpdateActionResult failed"), fctx.With(ctx))
+		ExecutionMetadata: eam,
+	}, nil
 }
 
-// uploadToCAS uses the bytestream client to upload the file to CAS.
-func (c *client) uploadToCAS(ctx context.Context, f *os.File) (d *remoteexecution.Digest, err error) {
-	hash := sha256.New()
-	if _, err = io.Copy(hash, f); err != nil {
-		err = fault.Wrap(err, fmsg.With("error hashing file"), fctx.With(ctx))
-		return
-	}
-
-	fi, err := f.Stat()
-	if err != nil {
-		err = fault.Wrap(err, fmsg.With("error getting file info"), fctx.With(ctx))
-		return
-	}
-
-	d = &remoteexecution.Digest{
-		Hash:      fmt.Sprintf("%x", hash.Sum(nil)),
-		SizeBytes: fi.Size(),
-	}
-	_, err = f.Seek(0, 0)
-	if err != nil {
-		err = fault.Wrap(err, fmsg.With("error seeking file"), fctx.With(ctx))
+// findCacheBlob returns the artifact referenced by an action result created by newActionResult.
+func findCacheBlob(ctx context.Context, ar *remoteexecution.ActionResult) (of *remoteexecution.OutputFile, md Metadata, err error) {
+	idx := slices.IndexFunc(ar.GetOutputFiles(), func(f *remoteexecution.OutputFile) bool {
+		return f.GetPath() == blobFileName
+	})
+	if idx < 0 {
+		err = fault.New("cache blob not found amount output files", fctx.With(ctx))
 		return
 	}
+	md, err = convertMetadataFromProto(ar.GetExecutionMetadata().GetAuxiliaryMetadata())
+	of = ar.OutputFiles[idx]
+	return
+}
 
+// uploadToCAS uses the bytestream client to upload the content of r with digest d to CAS.
+func (c *client) uploadToCAS(ctx context.Context, r io.Reader, d *remoteexecution.Digest) error {
 	w, err := c.bs.NewWriter(ctx, getUploadResourceName(d))
 	if err != nil {
-		err = fault.Wrap(err, fmsg.With("error creating upload writer"), fctx.With(ctx))
-		return
+		return fault.Wrap(err, fmsg.With("error creating upload writer"), fctx.With(ctx))
 	}
-	if _, err = io.Copy(w, f); err != nil {
-		err = fault.Wrap(err, fmsg.With("upload error"), fctx.With(ctx))
-		return
+	if _, err = io.Copy(w, r); err != nil {
+		return fault.Wrap(err, fmsg.With("upload error"), fctx.With(ctx))
 	}
-	err = w.Close()
-	return
+	return w.Close()
 }
 
 type acProto struct {
@@ -250,10 +277,8 @@ func convertMetadataFromProto(in []*anypb.Any) (Metadata, error) {
 // FindFile checks if a file was uploaded under given key. Returns true if file exists.
 func (c *client) FindFile(ctx context.Context, key string) (bool, error) {
 	if _, _, err := c.locateArtifact(ctx, key); err != nil {
-		if s, ok := status.FromError(err); ok {
-			if s.Code() == codes.NotFound {
-				return false, nil
-			}
+		if isNotFound(err) {
+			return false, nil
 		}
 		return false, err
 	}
@@ -261,27 +286,46 @@ func (c *client) FindFile(ctx context.Context, key string) (bool, error) {
 	return true, nil
 }
 
+// StatFile looks up the action result for key and returns the size and metadata of the artifact.
+func (c *client) StatFile(ctx context.Context, key string) (ArtifactInfo, error) {
+	of, md, err := c.locateArtifact(ctx, key)
+	if err != nil {
+		return ArtifactInfo{}, err
+	}
+	return ArtifactInfo{Size: of.GetDigest().GetSizeBytes(), Metadata: md}, nil
+}
+
+// StatFiles resolves action results for keys concurrently.
+func (c *client) StatFiles(ctx context.Context, keys []string) (map[string]ArtifactInfo, error) {
+	return statConcurrently(ctx, keys, c.StatFile)
+}
+
 // DownloadFile attempts to download a file from the remote cache identified by key. The file is
 // written to w.
-func (c *client) DownloadFile(ctx context.Context, key string, w io.Writer) (md Metadata, err error) {
+func (c *client) DownloadFile(ctx context.Context, key string, w io.Writer) (Metadata, error) {
+	return downloadFile(ctx, c, key, w)
+}
+
+// StreamFile looks up the action result for key and streams the artifact it refers to.
+func (c *client) StreamFile(ctx context.Context, key string, open OpenFunc) error {
 	of, md, err := c.locateArtifact(ctx, key)
 	if err != nil {
-		return
+		return err
 	}
-
 	rdr, err := c.bs.NewReader(ctx, getDownloadResourceName(of.GetDigest()))
 	if err != nil {
-		err = fault.Wrap(err, fmsg.With("NewReader failed"), fctx.With(ctx))
-		return
+		return fault.Wrap(err, fmsg.With("NewReader failed"), fctx.With(ctx))
 	}
-
 	defer func() { _ = rdr.Close() }()
 
+	w, err := open(ArtifactInfo{Size: of.GetDigest().GetSizeBytes(), Metadata: md})
+	if err != nil {
+		return err
+	}
 	if _, err = io.Copy(w, rdr); err != nil {
-		err = fault.Wrap(err, fmsg.With("fetching from bytestream client failed"), fctx.With(ctx))
-		return
+		return fault.Wrap(err, fmsg.With("fetching from bytestream client failed"), fctx.With(ctx))
 	}
-	return
+	return nil
 }
 
 func (c *client) locateArtifact(ctx context.Context, key string) (of *remoteexecution.OutputFile, md Metadata, err error) {
@@ -297,17 +341,7 @@ func (c *client) locateArtifact(ctx context.Context, key string) (of *remoteexec
 		err = fault.Wrap(err, fmsg.With("GetActionResult failed"), fctx.With(ctx))
 		return
 	}
-
-	idx := slices.IndexFunc(resp.OutputFiles, func(f *remoteexecution.OutputFile) bool {
-		return f.GetPath() == blobFileName
-	})
-	if idx < 0 {
-		err = fault.New("cache blob not found amount output files", fctx.With(ctx))
-		return
-	}
-	md, err = convertMetadataFromProto(resp.GetExecutionMetadata().GetAuxiliaryMetadata())
-	of = resp.OutputFiles[idx]
-	return
+	return findCacheBlob(ctx, resp)
 }
 
 func getDownloadResourceName(d *remoteexecution.Digest) string {
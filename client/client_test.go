@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"flag"
 	"fmt"
 	"os"
@@ -11,6 +12,7 @@ import (
 	"testing"
 	"time"
 
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"gotest.tools/v3/assert"
 )
 
@@ -65,6 +67,22 @@ func TestClientIntegration(t *testing.T) {
 	t.Run("nil metadata", func(t *testing.T) {
 		downloadAndUpload(ctx, t, cl, nil)
 	})
+
+	t.Run("reader with unknown digest", func(t *testing.T) {
+		uploadReaderAndDownload(ctx, t, cl, 4096, false)
+	})
+
+	t.Run("large reader with unknown size", func(t *testing.T) {
+		uploadReaderAndDownload(ctx, t, cl, maxInMemorySpool+1, false)
+	})
+
+	t.Run("reader with known digest", func(t *testing.T) {
+		uploadReaderAndDownload(ctx, t, cl, 4096, true)
+	})
+
+	t.Run("blob store", func(t *testing.T) {
+		writeAndReadBlob(ctx, t, NewBlobStore(cc))
+	})
 }
 
 func TestInmemoryClient(t *testing.T) {
@@ -75,17 +93,90 @@ func TestInmemoryClient(t *testing.T) {
 	assert.NilError(t, err)
 
 	downloadAndUpload(ctx, t, cl, nil)
+	uploadReaderAndDownload(ctx, t, cl, 4096, false)
 }
 
-func downloadAndUpload(ctx context.Context, t *testing.T, cl Interface, metadata Metadata) {
-	// Generate a random key
+func TestInMemoryBlobStore(t *testing.T) {
+	writeAndReadBlob(context.Background(), t, NewInMemoryBlobStore())
+}
+
+func writeAndReadBlob(ctx context.Context, t *testing.T, bs BlobStore) {
+	content := make([]byte, 4096)
+	_, err := rand.Read(content)
+	assert.NilError(t, err)
+	hash := fmt.Sprintf("%x", sha256.Sum256(content))
+
+	ok, err := bs.FindBlob(ctx, hash, int64(len(content)))
+	assert.NilError(t, err)
+	assert.Equal(t, ok, false)
+
+	err = bs.WriteBlob(ctx, hash, UnknownSize, bytes.NewReader(content[1:]))
+	assert.ErrorIs(t, err, ErrDigestMismatch)
+
+	err = bs.WriteBlob(ctx, hash, UnknownSize, bytes.NewReader(content))
+	assert.NilError(t, err)
+
+	ok, err = bs.FindBlob(ctx, hash, int64(len(content)))
+	assert.NilError(t, err)
+	assert.Equal(t, ok, true)
+
+	var downloaded bytes.Buffer
+	err = bs.ReadBlob(ctx, hash, int64(len(content)), &downloaded)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, downloaded.Bytes(), content)
+
+	// The action cache only needs the hash of the action
+	action := fmt.Sprintf("%x", sha256.Sum256([]byte(randomKey(t))))
+	_, err = bs.GetActionResult(ctx, action)
+	assert.ErrorContains(t, err, "code = NotFound")
+
+	ar := &remoteexecution.ActionResult{
+		OutputFiles: []*remoteexecution.OutputFile{{Path: "out", Digest: &remoteexecution.Digest{Hash: hash, SizeBytes: int64(len(content))}}},
+	}
+	assert.NilError(t, bs.UpdateActionResult(ctx, action, ar))
+
+	stored, err := bs.GetActionResult(ctx, action)
+	assert.NilError(t, err)
+	assert.Equal(t, stored.GetOutputFiles()[0].GetDigest().GetHash(), hash)
+}
+
+func uploadReaderAndDownload(ctx context.Context, t *testing.T, cl Interface, n int, knownDigest bool) {
+	key := randomKey(t)
+	content := make([]byte, n)
+	_, err := rand.Read(content)
+	assert.NilError(t, err)
+
+	var (
+		size   int64 = UnknownSize
+		digest string
+	)
+	if knownDigest {
+		size = int64(n)
+		digest = fmt.Sprintf("%x", sha256.Sum256(content))
+	}
+	err = cl.UploadReader(ctx, key, bytes.NewReader(content), size, digest, Metadata{"k": "v"})
+	assert.NilError(t, err)
+
+	var downloadedContent bytes.Buffer
+	md, err := cl.DownloadFile(ctx, key, &downloadedContent)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, downloadedContent.Bytes(), content)
+	assert.DeepEqual(t, md, Metadata{"k": "v"})
+}
+
+func randomKey(t *testing.T) string {
 	randombytes := make([]byte, 16)
 	_, err := rand.Read(randombytes)
 	assert.NilError(t, err)
 
 	key := fmt.Sprintf("tbc_test_%x", randombytes)
-
 	t.Logf("random key = %s", key)
+	return key
+}
+
+func downloadAndUpload(ctx context.Context, t *testing.T, cl Interface, metadata Metadata) {
+	// Generate a random key
+	key := randomKey(t)
 
 	// The key must not be present
 	ok, err := cl.FindFile(ctx, key)
@@ -98,7 +189,10 @@ func downloadAndUpload(ctx context.Context, t *testing.T, cl Interface, metadata
 		downloadedContent bytes.Buffer
 	)
 
-	// Attempt to download the file must fail
+	// Attempt to stat or download the file must fail
+	_, err = cl.StatFile(ctx, key)
+	assert.ErrorContains(t, err, "code = NotFound")
+
 	_, err = cl.DownloadFile(ctx, key, &downloadedContent)
 	assert.ErrorContains(t, err, "code = NotFound")
 	assert.Equal(t, downloadedContent.Len(), 0)
@@ -120,6 +214,15 @@ func downloadAndUpload(ctx context.Context, t *testing.T, cl Interface, metadata
 	assert.NilError(t, err)
 	assert.Equal(t, ok, true)
 
+	info, err := cl.StatFile(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, info.Size, int64(len(randomContent)))
+	assert.DeepEqual(t, info.Metadata, metadata)
+
+	infos, err := cl.StatFiles(ctx, []string{key, key + "_missing"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, infos, map[string]ArtifactInfo{key: info})
+
 	// Download the file
 	md, err := cl.DownloadFile(ctx, key, &downloadedContent)
 	assert.NilError(t, err)
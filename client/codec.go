@@ -0,0 +1,330 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Southclaws/fault"
+	"github.com/Southclaws/fault/fctx"
+	"github.com/Southclaws/fault/fmsg"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// codecMetadataKey holds the codec of a recompressed artifact.
+	codecMetadataKey = "tbc-codec"
+	// originalCodecMetadataKey holds the codec the artifact was uploaded with.
+	originalCodecMetadataKey = "tbc-original-codec"
+	// originalSizeMetadataKey holds the size of the artifact once it's restored to the original codec.
+	originalSizeMetadataKey = "tbc-original-size"
+)
+
+// codec is a compression format that artifacts can be stored in.
+type codec struct {
+	name  string
+	magic []byte
+
+	newReader func(r io.Reader) (io.ReadCloser, error)
+	// newWriter creates a compressor; best selects the highest compression level.
+	newWriter func(w io.Writer, best bool) (io.WriteCloser, error)
+}
+
+var codecs = []*codec{
+	{
+		name:  "gzip",
+		magic: []byte{0x1f, 0x8b},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		newWriter: func(w io.Writer, best bool) (io.WriteCloser, error) {
+			if best {
+				return gzip.NewWriterLevel(w, gzip.BestCompression)
+			}
+			return gzip.NewWriter(w), nil
+		},
+	},
+	{
+		name:  "zstd",
+		magic: []byte{0x28, 0xb5, 0x2f, 0xfd},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+		newWriter: func(w io.Writer, best bool) (io.WriteCloser, error) {
+			level := zstd.SpeedDefault
+			if best {
+				level = zstd.SpeedBestCompression
+			}
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+		},
+	},
+}
+
+func findCodec(name string) *codec {
+	for _, c := range codecs {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// detectCodec identifies the codec by the first bytes of the content. Returns nil if it's unknown.
+func detectCodec(header []byte) *codec {
+	for _, c := range codecs {
+		if bytes.HasPrefix(header, c.magic) {
+			return c
+		}
+	}
+	return nil
+}
+
+// transcode decompresses src with from and compresses the result with to.
+func transcode(dst io.Writer, src io.Reader, from, to *codec) error {
+	zr, err := from.newReader(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = zr.Close() }()
+
+	zw, err := to.newWriter(dst, false)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(zw, zr); err != nil {
+		_ = zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// recompress decompresses src with from and compresses the result with to at the highest level. It returns the
+// size of the artifact restored from dst by transcode, which is computed by compressing the content with from again.
+func recompress(dst io.Writer, src io.Reader, from, to *codec) (restoredSize int64, err error) {
+	zr, err := from.newReader(src)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = zr.Close() }()
+
+	var restored sizeCounter
+	rw, err := from.newWriter(&restored, false)
+	if err != nil {
+		return 0, err
+	}
+	zw, err := to.newWriter(dst, true)
+	if err != nil {
+		_ = rw.Close()
+		return 0, err
+	}
+	_, err = io.Copy(zw, io.TeeReader(zr, rw))
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := rw.Close(); err == nil {
+		err = closeErr
+	}
+	return int64(restored), err
+}
+
+// sizeCounter counts the bytes written to it.
+type sizeCounter int64
+
+func (c *sizeCounter) Write(p []byte) (int, error) {
+	*c += sizeCounter(len(p))
+	return len(p), nil
+}
+
+// codecClient recompresses artifacts before they are stored and restores their original format on download.
+type codecClient struct {
+	inner Interface
+	codec *codec
+}
+
+var _ Interface = (*codecClient)(nil)
+
+// NewCodecClient wraps inner so that gzip and zstd artifacts are recompressed with the named codec ("zstd" or
+// "gzip") at the highest level. The codecs are recorded in the metadata, and downloads are decoded back to the
+// original format. The original bytes are not preserved, so signed artifacts (x-artifact-tag) are stored as is.
+// Recompressed artifacts are spooled to a temp file before they are uploaded, since their size after the download
+// is recorded in the metadata.
+func NewCodecClient(inner Interface, name string) (Interface, error) {
+	c := findCodec(name)
+	if c == nil {
+		var names []string
+		for _, c := range codecs {
+			names = append(names, c.name)
+		}
+		return nil, fmt.Errorf("unknown codec %q, must be one of %s", name, strings.Join(names, ", "))
+	}
+	return &codecClient{inner: inner, codec: c}, nil
+}
+
+func (c *codecClient) CheckCapabilities(ctx context.Context) error {
+	return c.inner.CheckCapabilities(ctx)
+}
+
+func (c *codecClient) UploadFile(ctx context.Context, key, filePath string, metadata Metadata) error {
+	return uploadFileViaReader(ctx, c, key, filePath, metadata)
+}
+
+func (c *codecClient) UploadReader(ctx context.Context, key string, r io.Reader, size int64, digest string, metadata Metadata) error {
+	if _, signed := metadata["x-artifact-tag"]; signed {
+		return c.inner.UploadReader(ctx, key, r, size, digest, metadata)
+	}
+
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(4)
+	original := detectCodec(header)
+	if original == nil {
+		return c.inner.UploadReader(ctx, key, br, size, digest, metadata)
+	}
+
+	f, err := os.CreateTemp("", "tbc-upload-*.tmp")
+	if err != nil {
+		return fault.Wrap(err, fmsg.With("error creating a temp file"), fctx.With(ctx))
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	h := sha256.New()
+	restoredSize, err := recompress(io.MultiWriter(f, h), br, original, c.codec)
+	if err != nil {
+		return fault.Wrap(err, fmsg.With("error recompressing artifact"), fctx.With(ctx))
+	}
+	n, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return fault.Wrap(err, fmsg.With("error seeking file"), fctx.With(ctx))
+	}
+
+	md := make(Metadata, len(metadata)+3)
+	for k, v := range metadata {
+		md[k] = v
+	}
+	md[codecMetadataKey] = c.codec.name
+	md[originalCodecMetadataKey] = original.name
+	md[originalSizeMetadataKey] = strconv.FormatInt(restoredSize, 10)
+
+	return c.inner.UploadReader(ctx, key, f, n, newDigest(h, n).GetHash(), md)
+}
+
+func (c *codecClient) FindFile(ctx context.Context, key string) (bool, error) {
+	return c.inner.FindFile(ctx, key)
+}
+
+func (c *codecClient) StatFile(ctx context.Context, key string) (ArtifactInfo, error) {
+	info, err := c.inner.StatFile(ctx, key)
+	if err != nil {
+		return ArtifactInfo{}, err
+	}
+	return c.restoreInfo(info), nil
+}
+
+func (c *codecClient) StatFiles(ctx context.Context, keys []string) (map[string]ArtifactInfo, error) {
+	found, err := c.inner.StatFiles(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	for key, info := range found {
+		found[key] = c.restoreInfo(info)
+	}
+	return found, nil
+}
+
+// restoreInfo describes the artifact as it will be downloaded. The size is UnknownSize if the artifact was stored
+// without originalSizeMetadataKey.
+func (c *codecClient) restoreInfo(info ArtifactInfo) ArtifactInfo {
+	if stored, original := codecsOf(info.Metadata); stored != nil && stored != original {
+		info.Size = UnknownSize
+		if s, ok := info.Metadata[originalSizeMetadataKey].(string); ok {
+			if size, err := strconv.ParseInt(s, 10, 64); err == nil {
+				info.Size = size
+			}
+		}
+	}
+	info.Metadata = stripCodecMetadata(info.Metadata)
+	return info
+}
+
+// DownloadFile writes the artifact to w in its original format.
+func (c *codecClient) DownloadFile(ctx context.Context, key string, w io.Writer) (Metadata, error) {
+	return downloadFile(ctx, c, key, w)
+}
+
+// StreamFile writes the artifact in its original format to the writer returned by open.
+func (c *codecClient) StreamFile(ctx context.Context, key string, open OpenFunc) error {
+	var (
+		pw   *io.PipeWriter
+		done chan error
+	)
+	err := c.inner.StreamFile(ctx, key, func(info ArtifactInfo) (io.Writer, error) {
+		w, err := open(c.restoreInfo(info))
+		if err != nil {
+			return nil, err
+		}
+		stored, original := codecsOf(info.Metadata)
+		if stored == nil || stored == original {
+			return w, nil
+		}
+
+		var pr *io.PipeReader
+		pr, pw = io.Pipe()
+		done = make(chan error, 1)
+		go func() {
+			err := transcode(w, pr, stored, original)
+			_ = pr.CloseWithError(err)
+			done <- err
+		}()
+		return pw, nil
+	})
+	if pw == nil {
+		return err
+	}
+
+	_ = pw.CloseWithError(err)
+	if transcodeErr := <-done; err == nil && transcodeErr != nil {
+		err = fault.Wrap(transcodeErr, fmsg.With("error decoding artifact"), fctx.With(ctx))
+	}
+	return err
+}
+
+// codecsOf returns the codecs recorded in the metadata of a recompressed artifact, or nils.
+func codecsOf(md Metadata) (stored, original *codec) {
+	storedName, _ := md[codecMetadataKey].(string)
+	originalName, _ := md[originalCodecMetadataKey].(string)
+	stored, original = findCodec(storedName), findCodec(originalName)
+	if stored == nil || original == nil {
+		return nil, nil
+	}
+	return stored, original
+}
+
+// stripCodecMetadata removes the keys added by codecClient.
+func stripCodecMetadata(md Metadata) Metadata {
+	if _, ok := md[codecMetadataKey]; !ok {
+		return md
+	}
+	result := make(Metadata, len(md))
+	for k, v := range md {
+		if k != codecMetadataKey && k != originalCodecMetadataKey && k != originalSizeMetadataKey {
+			result[k] = v
+		}
+	}
+	return result
+}
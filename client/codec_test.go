@@ -0,0 +1,121 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"gotest.tools/v3/assert"
+)
+
+func TestCodecClient(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		content = bytes.Repeat([]byte("some very compressible tarball content "), 1000)
+	)
+
+	compress := func(t *testing.T, name string) []byte {
+		var buf bytes.Buffer
+		zw, err := findCodec(name).newWriter(&buf, false)
+		assert.NilError(t, err)
+		_, err = zw.Write(content)
+		assert.NilError(t, err)
+		assert.NilError(t, zw.Close())
+		return buf.Bytes()
+	}
+
+	_, err := NewCodecClient(NewInMemoryClient(), "brotli")
+	assert.ErrorContains(t, err, "unknown codec")
+
+	for _, tt := range []struct{ codec, original string }{
+		{"zstd", "gzip"},
+		{"zstd", "zstd"},
+		{"gzip", "zstd"},
+	} {
+		t.Run(tt.original+" as "+tt.codec, func(t *testing.T) {
+			inner := NewInMemoryClient()
+			cl, err := NewCodecClient(inner, tt.codec)
+			assert.NilError(t, err)
+
+			artifact := compress(t, tt.original)
+			md := Metadata{"x-artifact-duration": "42"}
+			assert.NilError(t, cl.UploadReader(ctx, "key", bytes.NewReader(artifact), int64(len(artifact)), "", md))
+
+			// stored recompressed
+			var stored bytes.Buffer
+			storedMd, err := inner.DownloadFile(ctx, "key", &stored)
+			assert.NilError(t, err)
+			assert.Assert(t, detectCodec(stored.Bytes()) == findCodec(tt.codec))
+			assert.Equal(t, storedMd[codecMetadataKey], tt.codec)
+			assert.Equal(t, storedMd[originalCodecMetadataKey], tt.original)
+
+			info, err := cl.StatFile(ctx, "key")
+			assert.NilError(t, err)
+			assert.DeepEqual(t, info.Metadata, md)
+
+			// downloaded in the original format
+			var downloaded bytes.Buffer
+			downloadedMd, err := cl.DownloadFile(ctx, "key", &downloaded)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, downloadedMd, md)
+			assert.Equal(t, info.Size, int64(downloaded.Len()))
+			assert.Assert(t, detectCodec(downloaded.Bytes()) == findCodec(tt.original))
+			assert.DeepEqual(t, decompress(t, downloaded.Bytes()), content)
+		})
+	}
+
+	t.Run("stores signed and unknown artifacts as is", func(t *testing.T) {
+		inner := NewInMemoryClient()
+		cl, err := NewCodecClient(inner, "zstd")
+		assert.NilError(t, err)
+
+		gzipped := compress(t, "gzip")
+		signedMd := Metadata{"x-artifact-tag": "tag"}
+		assert.NilError(t, cl.UploadReader(ctx, "signed", bytes.NewReader(gzipped), UnknownSize, "", signedMd))
+		assert.NilError(t, cl.UploadReader(ctx, "plain", bytes.NewReader(content), UnknownSize, "", nil))
+
+		for key, want := range map[string][]byte{"signed": gzipped, "plain": content} {
+			var buf bytes.Buffer
+			_, err = inner.DownloadFile(ctx, key, &buf)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, buf.Bytes(), want)
+
+			buf.Reset()
+			_, err = cl.DownloadFile(ctx, key, &buf)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, buf.Bytes(), want)
+		}
+	})
+
+	t.Run("corrupt artifact", func(t *testing.T) {
+		cl, err := NewCodecClient(NewInMemoryClient(), "zstd")
+		assert.NilError(t, err)
+
+		corrupt := compress(t, "gzip")[:100]
+		err = cl.UploadReader(ctx, "key", bytes.NewReader(corrupt), UnknownSize, "", nil)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+}
+
+func decompress(t *testing.T, data []byte) []byte {
+	var (
+		zr  io.Reader
+		err error
+	)
+	switch detectCodec(data) {
+	case findCodec("gzip"):
+		zr, err = gzip.NewReader(bytes.NewReader(data))
+	case findCodec("zstd"):
+		zr, err = zstd.NewReader(bytes.NewReader(data))
+	default:
+		t.Fatal("unknown codec")
+	}
+	assert.NilError(t, err)
+
+	result, err := io.ReadAll(zr)
+	assert.NilError(t, err)
+	return result
+}
@@ -19,17 +19,12 @@ const (
 func NewClientConn(host string, certPEMBlock, keyPEMBlock []byte) (*grpc.ClientConn, error) {
 	var creds credentials.TransportCredentials
 
-	if len(certPEMBlock) > 0 || len(keyPEMBlock) > 0 {
-		if len(certPEMBlock) == 0 || len(keyPEMBlock) == 0 {
-			return nil, fault.New("only one of certPEMBlock and keyPEMBlock was provided")
-		}
-		cert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
-		if err != nil {
-			return nil, err
-		}
-		creds = credentials.NewTLS(&tls.Config{
-			Certificates: []tls.Certificate{cert},
-		})
+	tlsConfig, err := newTLSConfig(certPEMBlock, keyPEMBlock)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
 	} else {
 		creds = insecure.NewCredentials()
 	}
@@ -41,3 +36,20 @@ func NewClientConn(host string, certPEMBlock, keyPEMBlock []byte) (*grpc.ClientC
 		grpc.WithInitialConnWindowSize(windowSize),
 	)
 }
+
+// newTLSConfig returns the TLS config presenting the client certificate, or nil if there is none.
+func newTLSConfig(certPEMBlock, keyPEMBlock []byte) (*tls.Config, error) {
+	if len(certPEMBlock) == 0 && len(keyPEMBlock) == 0 {
+		return nil, nil
+	}
+	if len(certPEMBlock) == 0 || len(keyPEMBlock) == 0 {
+		return nil, fault.New("only one of certPEMBlock and keyPEMBlock was provided")
+	}
+	cert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"context"
+	"io"
+
+	"github.com/Southclaws/fault"
+	"github.com/Southclaws/fault/fctx"
+	"github.com/Southclaws/fault/fmsg"
+)
+
+// diskCache serves artifacts from a local disk store and falls back to another client on misses.
+// Uploads are written through to the other client.
+type diskCache struct {
+	store  *diskStore
+	remote Interface
+}
+
+var _ Interface = (*diskCache)(nil)
+
+// NewDiskCache wraps remote with an on-disk LRU cache at dir limited to maxSize bytes (0 means no limit).
+// The directory can be shared by several processes.
+func NewDiskCache(remote Interface, dir string, maxSize int64) (Interface, error) {
+	store, err := newDiskStore(dir, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return &diskCache{store: store, remote: remote}, nil
+}
+
+func (c *diskCache) CheckCapabilities(ctx context.Context) error {
+	return c.remote.CheckCapabilities(ctx)
+}
+
+func (c *diskCache) UploadFile(ctx context.Context, key, filePath string, metadata Metadata) error {
+	return uploadFileViaReader(ctx, c, key, filePath, metadata)
+}
+
+// UploadReader uploads the content to the remote client, keeping a local copy on success.
+func (c *diskCache) UploadReader(ctx context.Context, key string, r io.Reader, size int64, digest string, metadata Metadata) error {
+	p, err := c.store.create()
+	if err != nil {
+		return fault.Wrap(err, fctx.With(ctx))
+	}
+
+	if err = c.remote.UploadReader(ctx, key, io.TeeReader(r, p), size, digest, metadata); err != nil {
+		p.abort()
+		return err
+	}
+	// The local copy is best effort.
+	_ = p.commit(key, metadata)
+	return nil
+}
+
+func (c *diskCache) FindFile(ctx context.Context, key string) (bool, error) {
+	if _, err := c.store.stat(key); err == nil {
+		return true, nil
+	}
+	return c.remote.FindFile(ctx, key)
+}
+
+func (c *diskCache) StatFile(ctx context.Context, key string) (ArtifactInfo, error) {
+	if info, err := c.store.stat(key); err == nil {
+		return info, nil
+	}
+	return c.remote.StatFile(ctx, key)
+}
+
+func (c *diskCache) StatFiles(ctx context.Context, keys []string) (map[string]ArtifactInfo, error) {
+	var (
+		result = make(map[string]ArtifactInfo, len(keys))
+		misses []string
+	)
+	for _, key := range keys {
+		if info, err := c.store.stat(key); err == nil {
+			result[key] = info
+		} else {
+			misses = append(misses, key)
+		}
+	}
+	if len(misses) == 0 {
+		return result, nil
+	}
+
+	remote, err := c.remote.StatFiles(ctx, misses)
+	if err != nil {
+		return nil, err
+	}
+	for key, info := range remote {
+		result[key] = info
+	}
+	return result, nil
+}
+
+func (c *diskCache) DownloadFile(ctx context.Context, key string, w io.Writer) (Metadata, error) {
+	return downloadFile(ctx, c, key, w)
+}
+
+// StreamFile serves the artifact from disk if possible. Otherwise, it is downloaded from the remote client
+// and stored locally.
+func (c *diskCache) StreamFile(ctx context.Context, key string, open OpenFunc) error {
+	if e, err := c.store.open(key); err == nil {
+		defer e.close()
+		w, err := open(e.info())
+		if err != nil {
+			return err
+		}
+		if err = e.writeTo(w); err != nil {
+			return fault.Wrap(err, fmsg.With("error reading cache entry"), fctx.With(ctx))
+		}
+		e.touch()
+		return nil
+	}
+
+	p, err := c.store.create()
+	if err != nil {
+		return fault.Wrap(err, fctx.With(ctx))
+	}
+
+	var md Metadata
+	err = c.remote.StreamFile(ctx, key, func(info ArtifactInfo) (io.Writer, error) {
+		md = info.Metadata
+		w, err := open(info)
+		if err != nil {
+			return nil, err
+		}
+		return io.MultiWriter(w, p), nil
+	})
+	if err != nil {
+		p.abort()
+		return err
+	}
+	// The local copy is best effort.
+	_ = p.commit(key, md)
+	return nil
+}
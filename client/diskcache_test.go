@@ -0,0 +1,141 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestDiskCache(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		dir    = t.TempDir()
+		remote = NewInMemoryClient()
+	)
+	cl, err := NewDiskCache(remote, dir, 0)
+	assert.NilError(t, err)
+
+	downloadAndUpload(ctx, t, cl, Metadata{"x-artifact-duration": "42"})
+	uploadReaderAndDownload(ctx, t, cl, 4096, false)
+
+	t.Run("writes through and serves hits locally", func(t *testing.T) {
+		err := cl.UploadReader(ctx, "key", bytes.NewBufferString("DATA"), 4, "", Metadata{"k": "v"})
+		assert.NilError(t, err)
+
+		ok, err := remote.FindFile(ctx, "key")
+		assert.NilError(t, err)
+		assert.Equal(t, ok, true)
+
+		// another process sharing the directory, but with an empty remote
+		cl2, err := NewDiskCache(NewInMemoryClient(), dir, 0)
+		assert.NilError(t, err)
+
+		info, err := cl2.StatFile(ctx, "key")
+		assert.NilError(t, err)
+		assert.DeepEqual(t, info, ArtifactInfo{Size: 4, Metadata: Metadata{"k": "v"}})
+
+		var buf bytes.Buffer
+		md, err := cl2.DownloadFile(ctx, "key", &buf)
+		assert.NilError(t, err)
+		assert.Equal(t, buf.String(), "DATA")
+		assert.DeepEqual(t, md, Metadata{"k": "v"})
+	})
+
+	t.Run("stores remote hits", func(t *testing.T) {
+		uploadToClient(t, remote, "remote-only", []byte("REMOTE"), nil)
+
+		infos, err := cl.StatFiles(ctx, []string{"key", "remote-only", "missing"})
+		assert.NilError(t, err)
+		assert.Equal(t, len(infos), 2)
+
+		var buf bytes.Buffer
+		_, err = cl.DownloadFile(ctx, "remote-only", &buf)
+		assert.NilError(t, err)
+		assert.Equal(t, buf.String(), "REMOTE")
+
+		_, err = os.Stat(cl.(*diskCache).store.path("remote-only"))
+		assert.NilError(t, err)
+	})
+}
+
+func TestDiskStoreEviction(t *testing.T) {
+	const entrySize = 1000
+
+	store, err := newDiskStore(t.TempDir(), 5*entrySize)
+	assert.NilError(t, err)
+
+	past := time.Now().Add(-time.Hour)
+	for i := 0; i < 4; i++ {
+		putEntry(t, store, fmt.Sprintf("key%d", i), entrySize)
+		// make access order deterministic
+		assert.NilError(t, os.Chtimes(store.path(fmt.Sprintf("key%d", i)), past, past.Add(time.Duration(i)*time.Minute)))
+	}
+
+	// key0 is the oldest, but it was used recently
+	e, err := store.open("key0")
+	assert.NilError(t, err)
+	e.touch()
+	e.close()
+
+	putEntry(t, store, "key4", entrySize)
+	putEntry(t, store, "key5", entrySize)
+
+	for key, present := range map[string]bool{
+		"key0": true, "key1": false, "key2": false, "key3": true, "key4": true, "key5": true,
+	} {
+		_, err := store.stat(key)
+		assert.Equal(t, err == nil, present, key)
+	}
+}
+
+func TestDiskStoreConcurrentProcesses(t *testing.T) {
+	dir := t.TempDir()
+
+	var wg sync.WaitGroup
+	for p := 0; p < 4; p++ {
+		store, err := newDiskStore(dir, 20*1000)
+		assert.NilError(t, err)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				putEntry(t, store, fmt.Sprintf("key%d", i), 1000)
+				if e, err := store.open(fmt.Sprintf("key%d", i/2)); err == nil {
+					assert.Check(t, e.writeTo(new(bytes.Buffer)))
+					e.close()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries, err := countDiskStoreEntries(dir)
+	assert.NilError(t, err)
+	assert.Assert(t, entries <= 21, "%d entries left", entries)
+}
+
+func countDiskStoreEntries(dir string) (int, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "??", "*"))
+	return len(matches), err
+}
+
+func putEntry(t *testing.T, store *diskStore, key string, size int) {
+	p, err := store.create()
+	assert.NilError(t, err)
+	_, err = p.Write(bytes.Repeat([]byte{'x'}, size-entryFooterSize-len("null")))
+	assert.NilError(t, err)
+	assert.NilError(t, p.commit(key, nil))
+}
+
+func uploadToClient(t *testing.T, cl Interface, key string, data []byte, md Metadata) {
+	err := cl.UploadReader(context.Background(), key, bytes.NewReader(data), int64(len(data)), "", md)
+	assert.NilError(t, err)
+}
@@ -0,0 +1,325 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Southclaws/fault"
+	"github.com/Southclaws/fault/fmsg"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// entryFooterSize is the size of the trailing metadata length of every entry.
+	entryFooterSize = 8
+	// diskStoreTmpDir is where entries are written before they are renamed into place.
+	diskStoreTmpDir = "tmp"
+	// staleTmpAge is the age after which abandoned temp files are removed.
+	staleTmpAge = time.Hour
+	// evictionTarget is the fraction of maxSize that eviction shrinks the store to, so that it does not have
+	// to run on every write.
+	evictionTarget = 0.9
+)
+
+// diskStore keeps artifacts under a directory, sharded by the SHA256 of the key:
+//
+//	<dir>/<first two hex digits>/<sha256(key)>
+//
+// Every entry is the artifact followed by JSON-encoded metadata and its 8-byte big-endian length, so that
+// both can be written in one pass and made visible with a single rename. The store can be shared by several
+// processes: entries are never modified in place, and eviction is serialized with a file lock.
+type diskStore struct {
+	dir string
+	// maxSize caps the total size of the entries (0 means no limit). Least recently used entries are evicted
+	// first.
+	maxSize int64
+
+	mu sync.Mutex
+	// approxSize is the total size of entries as known to this process. Other processes can change it, so
+	// it is recomputed on eviction.
+	approxSize int64
+}
+
+func newDiskStore(dir string, maxSize int64) (*diskStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, diskStoreTmpDir), 0755); err != nil {
+		return nil, fault.Wrap(err, fmsg.With("error creating cache directory"))
+	}
+
+	ds := &diskStore{dir: dir, maxSize: maxSize}
+	if maxSize > 0 {
+		entries, err := ds.scan()
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			ds.approxSize += e.size
+		}
+	}
+	return ds, nil
+}
+
+func (ds *diskStore) path(key string) string {
+	h := fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+	return filepath.Join(ds.dir, h[:2], h)
+}
+
+// diskEntry is an open entry of the store.
+type diskEntry struct {
+	f        *os.File
+	size     int64
+	metadata Metadata
+}
+
+// open opens the entry for key. Returns a NotFound status error if there is none.
+func (ds *diskStore) open(key string) (*diskEntry, error) {
+	f, err := os.Open(ds.path(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, status.Error(codes.NotFound, "artifact not found")
+		}
+		return nil, fault.Wrap(err, fmsg.With("error opening cache entry"))
+	}
+
+	e, err := readEntry(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fault.Wrap(err, fmsg.With(fmt.Sprintf("corrupt cache entry %s", f.Name())))
+	}
+	return e, nil
+}
+
+func readEntry(f *os.File) (*diskEntry, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var footer [entryFooterSize]byte
+	if _, err = f.ReadAt(footer[:], fi.Size()-entryFooterSize); err != nil {
+		return nil, err
+	}
+	mdLen := int64(binary.BigEndian.Uint64(footer[:]))
+	size := fi.Size() - entryFooterSize - mdLen
+	if mdLen < 0 || size < 0 {
+		return nil, errors.New("bad metadata length")
+	}
+
+	var md Metadata
+	if err = json.NewDecoder(io.NewSectionReader(f, size, mdLen)).Decode(&md); err != nil {
+		return nil, err
+	}
+	return &diskEntry{f: f, size: size, metadata: md}, nil
+}
+
+func (e *diskEntry) info() ArtifactInfo {
+	return ArtifactInfo{Size: e.size, Metadata: e.metadata}
+}
+
+// writeTo copies the artifact to w.
+func (e *diskEntry) writeTo(w io.Writer) error {
+	_, err := io.Copy(w, io.NewSectionReader(e.f, 0, e.size))
+	return err
+}
+
+// touch marks the entry as recently used.
+func (e *diskEntry) touch() {
+	now := time.Now()
+	_ = os.Chtimes(e.f.Name(), now, now)
+}
+
+func (e *diskEntry) close() {
+	_ = e.f.Close()
+}
+
+// stat returns the size and metadata of the entry for key.
+func (ds *diskStore) stat(key string) (ArtifactInfo, error) {
+	e, err := ds.open(key)
+	if err != nil {
+		return ArtifactInfo{}, err
+	}
+	defer e.close()
+	return e.info(), nil
+}
+
+// pendingEntry is an entry being written. It becomes visible after commit.
+type pendingEntry struct {
+	ds  *diskStore
+	f   *os.File
+	n   int64
+	err error
+}
+
+// create starts writing a new entry.
+func (ds *diskStore) create() (*pendingEntry, error) {
+	f, err := os.CreateTemp(filepath.Join(ds.dir, diskStoreTmpDir), "entry-*.tmp")
+	if err != nil {
+		return nil, fault.Wrap(err, fmsg.With("error creating a temp file"))
+	}
+	return &pendingEntry{ds: ds, f: f}, nil
+}
+
+// Write never fails, so that a pending entry can be fed with io.TeeReader or io.MultiWriter without affecting
+// the main stream. Write errors are reported by commit.
+func (p *pendingEntry) Write(b []byte) (int, error) {
+	if p.err == nil {
+		var n int
+		n, p.err = p.f.Write(b)
+		p.n += int64(n)
+	}
+	return len(b), nil
+}
+
+// commit stores the written data with metadata under key, replacing the existing entry, if any.
+func (p *pendingEntry) commit(key string, metadata Metadata) error {
+	defer p.abort()
+
+	if p.err != nil {
+		return fault.Wrap(p.err, fmsg.With("error writing cache entry"))
+	}
+
+	mdData, err := json.Marshal(metadata)
+	if err != nil {
+		return fault.Wrap(err, fmsg.With("error encoding metadata"))
+	}
+	var footer [entryFooterSize]byte
+	binary.BigEndian.PutUint64(footer[:], uint64(len(mdData)))
+
+	if _, err = p.f.Write(append(mdData, footer[:]...)); err != nil {
+		return fault.Wrap(err, fmsg.With("error writing cache entry"))
+	}
+	if err = p.f.Close(); err != nil {
+		return fault.Wrap(err, fmsg.With("error writing cache entry"))
+	}
+
+	path := p.ds.path(key)
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fault.Wrap(err, fmsg.With("error creating cache directory"))
+	}
+	if err = os.Rename(p.f.Name(), path); err != nil {
+		return fault.Wrap(err, fmsg.With("error storing cache entry"))
+	}
+
+	p.ds.added(p.n + int64(len(mdData)) + entryFooterSize)
+	return nil
+}
+
+// abort discards the entry. It is a no-op after commit.
+func (p *pendingEntry) abort() {
+	_ = p.f.Close()
+	_ = os.Remove(p.f.Name())
+}
+
+// added accounts for a new entry of the given size and evicts old entries if the store grew too large.
+func (ds *diskStore) added(size int64) {
+	if ds.maxSize <= 0 {
+		return
+	}
+
+	ds.mu.Lock()
+	ds.approxSize += size
+	overflow := ds.approxSize > ds.maxSize
+	ds.mu.Unlock()
+
+	if overflow {
+		_ = ds.evict()
+	}
+}
+
+type diskStoreEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// scan lists all entries of the store.
+func (ds *diskStore) scan() (entries []diskStoreEntry, err error) {
+	shards, err := os.ReadDir(ds.dir)
+	if err != nil {
+		return nil, fault.Wrap(err, fmsg.With("error reading cache directory"))
+	}
+	for _, shard := range shards {
+		if !shard.IsDir() || len(shard.Name()) != 2 {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(ds.dir, shard.Name()))
+		if err != nil {
+			continue // could have been removed concurrently
+		}
+		for _, file := range files {
+			fi, err := file.Info()
+			if err != nil {
+				continue
+			}
+			entries = append(entries, diskStoreEntry{
+				path:    filepath.Join(ds.dir, shard.Name(), file.Name()),
+				size:    fi.Size(),
+				modTime: fi.ModTime(),
+			})
+		}
+	}
+	return entries, nil
+}
+
+// evict removes least recently used entries until the store shrinks below evictionTarget of maxSize.
+// If another process is already evicting, it does nothing.
+func (ds *diskStore) evict() error {
+	unlock, ok, err := tryLockFile(filepath.Join(ds.dir, ".lock"))
+	if err != nil || !ok {
+		return err
+	}
+	defer unlock()
+
+	ds.removeStaleTmpFiles()
+
+	entries, err := ds.scan()
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+	target := int64(float64(ds.maxSize) * evictionTarget)
+	for _, e := range entries {
+		if total <= target {
+			break
+		}
+		if err := os.Remove(e.path); err == nil || errors.Is(err, fs.ErrNotExist) {
+			total -= e.size
+		}
+	}
+
+	ds.mu.Lock()
+	ds.approxSize = total
+	ds.mu.Unlock()
+	return nil
+}
+
+// removeStaleTmpFiles cleans up after processes that died while writing entries.
+func (ds *diskStore) removeStaleTmpFiles() {
+	tmpDir := filepath.Join(ds.dir, diskStoreTmpDir)
+	files, err := os.ReadDir(tmpDir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if fi, err := file.Info(); err == nil && strings.HasSuffix(fi.Name(), ".tmp") &&
+			time.Since(fi.ModTime()) > staleTmpAge {
+			_ = os.Remove(filepath.Join(tmpDir, file.Name()))
+		}
+	}
+}
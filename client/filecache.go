@@ -0,0 +1,117 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/Southclaws/fault"
+	"github.com/Southclaws/fault/fctx"
+	"github.com/Southclaws/fault/fmsg"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// fileClient stores artifacts directly in a directory, e.g. on an NFS mount shared by several runners, so that
+// no cache server is needed. See diskStore for the layout.
+type fileClient struct {
+	store *diskStore
+}
+
+var _ Interface = (*fileClient)(nil)
+
+// NewFileClient instantiates a client for the cache directory dir, limited to maxSize bytes (0 means no limit).
+// The directory can be shared by several processes and hosts.
+func NewFileClient(dir string, maxSize int64) (Interface, error) {
+	store, err := newDiskStore(dir, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return &fileClient{store: store}, nil
+}
+
+// CheckCapabilities checks that entries can be created in the directory.
+func (c *fileClient) CheckCapabilities(ctx context.Context) error {
+	p, err := c.store.create()
+	if err != nil {
+		return fault.Wrap(err, fctx.With(ctx))
+	}
+	p.abort()
+	return nil
+}
+
+func (c *fileClient) UploadFile(ctx context.Context, key, filePath string, metadata Metadata) error {
+	return uploadFileViaReader(ctx, c, key, filePath, metadata)
+}
+
+// UploadReader writes the content to a temp file, which replaces the entry for key once it is complete.
+func (c *fileClient) UploadReader(ctx context.Context, key string, r io.Reader, size int64, digest string, metadata Metadata) error {
+	if size >= 0 && digest != "" {
+		r = newDigestVerifier(r, &remoteexecution.Digest{Hash: digest, SizeBytes: size})
+	}
+
+	p, err := c.store.create()
+	if err != nil {
+		return fault.Wrap(err, fctx.With(ctx))
+	}
+	if _, err = io.Copy(p, r); err != nil {
+		p.abort()
+		return fault.Wrap(err, fmsg.With("error reading upload"), fctx.With(ctx))
+	}
+	if size >= 0 && p.n != size {
+		p.abort()
+		return fault.Wrap(fault.New(fmt.Sprintf("expected %d bytes, got %d", size, p.n)), fctx.With(ctx))
+	}
+	return fault.Wrap(p.commit(key, metadata), fctx.With(ctx))
+}
+
+func (c *fileClient) FindFile(ctx context.Context, key string) (bool, error) {
+	if _, err := c.store.stat(key); err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, fault.Wrap(err, fctx.With(ctx))
+	}
+	return true, nil
+}
+
+func (c *fileClient) StatFile(ctx context.Context, key string) (ArtifactInfo, error) {
+	info, err := c.store.stat(key)
+	return info, fault.Wrap(err, fctx.With(ctx))
+}
+
+func (c *fileClient) StatFiles(ctx context.Context, keys []string) (map[string]ArtifactInfo, error) {
+	result := make(map[string]ArtifactInfo, len(keys))
+	for _, key := range keys {
+		info, err := c.store.stat(key)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return nil, fault.Wrap(err, fctx.With(ctx))
+		}
+		result[key] = info
+	}
+	return result, nil
+}
+
+func (c *fileClient) DownloadFile(ctx context.Context, key string, w io.Writer) (Metadata, error) {
+	return downloadFile(ctx, c, key, w)
+}
+
+func (c *fileClient) StreamFile(ctx context.Context, key string, open OpenFunc) error {
+	e, err := c.store.open(key)
+	if err != nil {
+		return fault.Wrap(err, fctx.With(ctx))
+	}
+	defer e.close()
+
+	w, err := open(e.info())
+	if err != nil {
+		return err
+	}
+	if err = e.writeTo(w); err != nil {
+		return fault.Wrap(err, fmsg.With("error reading cache entry"), fctx.With(ctx))
+	}
+	e.touch()
+	return nil
+}
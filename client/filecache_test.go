@@ -0,0 +1,79 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestFileClient(t *testing.T) {
+	var (
+		ctx = context.Background()
+		dir = t.TempDir()
+	)
+	cl, err := NewFileClient(dir, 0)
+	assert.NilError(t, err)
+	assert.NilError(t, cl.CheckCapabilities(ctx))
+
+	downloadAndUpload(ctx, t, cl, Metadata{"x-artifact-duration": "42"})
+	uploadReaderAndDownload(ctx, t, cl, 4096, false)
+	uploadReaderAndDownload(ctx, t, cl, 4096, true)
+
+	t.Run("shared directory", func(t *testing.T) {
+		assert.NilError(t, cl.UploadReader(ctx, "key", strings.NewReader("DATA"), 4, "", Metadata{"k": "v"}))
+
+		cl2, err := NewFileClient(dir, 0)
+		assert.NilError(t, err)
+
+		var buf bytes.Buffer
+		md, err := cl2.DownloadFile(ctx, "key", &buf)
+		assert.NilError(t, err)
+		assert.Equal(t, buf.String(), "DATA")
+		assert.DeepEqual(t, md, Metadata{"k": "v"})
+
+		infos, err := cl2.StatFiles(ctx, []string{"key", "missing"})
+		assert.NilError(t, err)
+		assert.DeepEqual(t, infos, map[string]ArtifactInfo{"key": {Size: 4, Metadata: Metadata{"k": "v"}}})
+	})
+
+	t.Run("failed uploads leave no entries", func(t *testing.T) {
+		err := cl.UploadReader(ctx, "short", strings.NewReader("DATA"), 10, "", nil)
+		assert.ErrorContains(t, err, "expected 10 bytes, got 4")
+
+		err = cl.UploadReader(ctx, "tampered", strings.NewReader("DATA"), 4, strings.Repeat("0", 64), nil)
+		assert.ErrorIs(t, err, ErrDigestMismatch)
+
+		for _, key := range []string{"short", "tampered"} {
+			ok, err := cl.FindFile(ctx, key)
+			assert.NilError(t, err)
+			assert.Equal(t, ok, false)
+		}
+		tmpFiles, err := os.ReadDir(filepath.Join(dir, diskStoreTmpDir))
+		assert.NilError(t, err)
+		assert.Equal(t, len(tmpFiles), 0)
+	})
+
+	t.Run("eviction", func(t *testing.T) {
+		cl, err := NewFileClient(t.TempDir(), 10*1024)
+		assert.NilError(t, err)
+
+		for i := 0; i < 10; i++ {
+			err := cl.UploadReader(ctx, fmt.Sprintf("key%d", i), bytes.NewReader(make([]byte, 2048)), 2048, "", nil)
+			assert.NilError(t, err)
+		}
+
+		ok, err := cl.FindFile(ctx, "key0")
+		assert.NilError(t, err)
+		assert.Equal(t, ok, false)
+
+		ok, err = cl.FindFile(ctx, "key9")
+		assert.NilError(t, err)
+		assert.Equal(t, ok, true)
+	})
+}
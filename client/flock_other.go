@@ -0,0 +1,15 @@
+//go:build !unix
+
+package client
+
+import "os"
+
+// tryLockFile is a no-op on platforms without flock(2): eviction is not coordinated between processes there.
+func tryLockFile(string) (unlock func(), ok bool, err error) {
+	return func() {}, true, nil
+}
+
+// tryLock is a no-op on platforms without flock(2): outbox entries are not protected from concurrent replays there.
+func tryLock(*os.File) (ok bool, err error) {
+	return true, nil
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+)
+
+// newFakeHTTPCache starts a stand-in for bazel-remote that requires basic authentication with user:secret.
+func newFakeHTTPCache(t *testing.T) (*httptest.Server, map[string][]byte) {
+	var (
+		mu      sync.Mutex
+		entries = make(map[string][]byte)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/prefix/ac/") && !strings.HasPrefix(r.URL.Path, "/prefix/cas/") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.Method {
+		case http.MethodGet:
+			data, ok := entries[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(data)
+		case http.MethodPut:
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			entries[r.URL.Path] = data
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, entries
+}
+
+func TestHTTPClient(t *testing.T) {
+	var (
+		ctx          = context.Background()
+		srv, entries = newFakeHTTPCache(t)
+		baseURL      = strings.Replace(srv.URL, "http://", "http://user:secret@", 1) + "/prefix/"
+	)
+
+	cl, err := NewHTTPClient(baseURL, nil, nil)
+	assert.NilError(t, err)
+	assert.NilError(t, cl.CheckCapabilities(ctx))
+
+	downloadAndUpload(ctx, t, cl, Metadata{"key1": "value1"})
+	uploadReaderAndDownload(ctx, t, cl, 4096, false)
+	uploadReaderAndDownload(ctx, t, cl, 4096, true)
+
+	t.Run("same encoding as the gRPC client", func(t *testing.T) {
+		assert.NilError(t, cl.UploadReader(ctx, "key", strings.NewReader("content"), UnknownSize, "", nil))
+
+		acProtos, err := prepareACProtos("key")
+		assert.NilError(t, err)
+		for _, d := range []*remoteexecution.Digest{acProtos.command.digest, acProtos.action.digest} {
+			_, ok := entries["/prefix/cas/"+d.GetHash()]
+			assert.Assert(t, ok)
+		}
+
+		ar := &remoteexecution.ActionResult{}
+		assert.NilError(t, proto.Unmarshal(entries["/prefix/ac/"+acProtos.action.digest.GetHash()], ar))
+		assert.Equal(t, ar.GetOutputFiles()[0].GetPath(), blobFileName)
+		assert.Equal(t, ar.GetOutputFiles()[0].GetDigest().GetSizeBytes(), int64(len("content")))
+	})
+
+	t.Run("bad credentials", func(t *testing.T) {
+		cl, err := NewHTTPClient(srv.URL+"/prefix", nil, nil)
+		assert.NilError(t, err)
+		assert.ErrorContains(t, cl.CheckCapabilities(ctx), "401 Unauthorized")
+	})
+
+	t.Run("bad URL", func(t *testing.T) {
+		_, err := NewHTTPClient("ftp://cache", nil, nil)
+		assert.ErrorContains(t, err, "unsupported remote cache URL scheme ftp")
+	})
+}
@@ -3,15 +3,73 @@ package client
 import (
 	"context"
 	"io"
+	"os"
+
+	"github.com/Southclaws/fault"
+	"github.com/Southclaws/fault/fctx"
+	"github.com/Southclaws/fault/fmsg"
 )
 
 // Metadata contains additional keys-values stored with the uploaded file.
 type Metadata = map[string]any
 
+// UnknownSize can be passed to Interface.UploadReader when the content size is not known in advance.
+const UnknownSize = -1
+
+// ArtifactInfo describes an artifact stored in the cache.
+type ArtifactInfo struct {
+	// Size of the artifact in bytes, or UnknownSize if the backend doesn't know it before the download.
+	Size     int64
+	Metadata Metadata
+}
+
+// OpenFunc is called by Interface.StreamFile with the info of the artifact found. It returns the writer the content
+// is written to.
+type OpenFunc = func(info ArtifactInfo) (io.Writer, error)
+
 // Interface is the remote cache client interface.
 type Interface interface {
 	CheckCapabilities(ctx context.Context) error
 	UploadFile(ctx context.Context, key, filePath string, metadata Metadata) error
+	// UploadReader uploads the content read from r. size and digest (hex-encoded SHA256 of the content) are
+	// optional: pass UnknownSize and "" if they are not known in advance. Note that the REAPI client addresses
+	// blobs by digest, so without one the content is spooled to a temporary file first; it is streamed only when
+	// both size and digest are given.
+	UploadReader(ctx context.Context, key string, r io.Reader, size int64, digest string, metadata Metadata) error
 	FindFile(ctx context.Context, key string) (bool, error)
+	// StatFile looks up an artifact without downloading it. Returns a NotFound status error if there is none.
+	StatFile(ctx context.Context, key string) (ArtifactInfo, error)
+	// StatFiles looks up several artifacts at once. Keys that are not found are omitted from the result.
+	StatFiles(ctx context.Context, keys []string) (map[string]ArtifactInfo, error)
 	DownloadFile(ctx context.Context, key string, w io.Writer) (Metadata, error)
+	// StreamFile looks up an artifact and writes it to the writer returned by open. Unlike StatFile followed by
+	// DownloadFile, this takes a single lookup. Returns a NotFound status error if there is none, without calling open.
+	StreamFile(ctx context.Context, key string, open OpenFunc) error
+}
+
+// uploadFileViaReader implements UploadFile with UploadReader.
+func uploadFileViaReader(ctx context.Context, c Interface, key, filePath string, metadata Metadata) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return fault.Wrap(err, fmsg.With("error opening file"), fctx.With(ctx))
+	}
+	defer func() { _ = f.Close() }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fault.Wrap(err, fmsg.With("error getting file info"), fctx.With(ctx))
+	}
+	return c.UploadReader(ctx, key, f, fi.Size(), "", metadata)
+}
+
+// downloadFile implements DownloadFile with StreamFile.
+func downloadFile(ctx context.Context, c Interface, key string, w io.Writer) (md Metadata, err error) {
+	err = c.StreamFile(ctx, key, func(info ArtifactInfo) (io.Writer, error) {
+		md = info.Metadata
+		return w, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return md, nil
 }
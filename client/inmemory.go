@@ -2,9 +2,13 @@ package client
 
 import (
 	"context"
+	"crypto/sha256"
+	"fmt"
 	"io"
 	"os"
+	"sync"
 
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -15,6 +19,7 @@ type artifact struct {
 }
 
 type InMemoryClient struct {
+	mu        sync.RWMutex
 	artifacts map[string]artifact
 }
 
@@ -36,29 +41,148 @@ func (c *InMemoryClient) UploadFile(ctx context.Context, key, filePath string, m
 		return err
 	}
 
+	c.store(key, data, metadata)
+	return nil
+}
+
+func (c *InMemoryClient) UploadReader(ctx context.Context, key string, r io.Reader, _ int64, _ string, metadata Metadata) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	c.store(key, data, metadata)
+	return nil
+}
+
+func (c *InMemoryClient) store(key string, data []byte, metadata Metadata) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.artifacts[key] = artifact{
 		data:     data,
 		metadata: metadata,
 	}
+}
 
-	return nil
+func (c *InMemoryClient) lookup(key string) (artifact, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	af, ok := c.artifacts[key]
+	return af, ok
 }
 
 func (c *InMemoryClient) FindFile(ctx context.Context, key string) (bool, error) {
-	if _, ok := c.artifacts[key]; ok {
+	if _, ok := c.lookup(key); ok {
 		return true, nil
 	}
 	return false, nil
 }
 
+func (c *InMemoryClient) StatFile(ctx context.Context, key string) (ArtifactInfo, error) {
+	if af, ok := c.lookup(key); ok {
+		return ArtifactInfo{Size: int64(len(af.data)), Metadata: af.metadata}, nil
+	}
+
+	return ArtifactInfo{}, status.Error(codes.NotFound, "artifact not found")
+}
+
+func (c *InMemoryClient) StatFiles(ctx context.Context, keys []string) (map[string]ArtifactInfo, error) {
+	result := make(map[string]ArtifactInfo)
+	for _, key := range keys {
+		if af, ok := c.lookup(key); ok {
+			result[key] = ArtifactInfo{Size: int64(len(af.data)), Metadata: af.metadata}
+		}
+	}
+	return result, nil
+}
+
 func (c *InMemoryClient) DownloadFile(ctx context.Context, key string, w io.Writer) (Metadata, error) {
-	if af, ok := c.artifacts[key]; ok {
-		_, err := w.Write(af.data)
+	return downloadFile(ctx, c, key, w)
+}
+
+func (c *InMemoryClient) StreamFile(ctx context.Context, key string, open OpenFunc) error {
+	if af, ok := c.lookup(key); ok {
+		w, err := open(ArtifactInfo{Size: int64(len(af.data)), Metadata: af.metadata})
 		if err != nil {
-			return nil, err
+			return err
 		}
-		return af.metadata, nil
+		_, err = w.Write(af.data)
+		return err
+	}
+
+	return status.Error(codes.NotFound, "artifact not found")
+}
+
+// InMemoryBlobStore is a BlobStore for tests. Like real servers, it requires blob sizes to match.
+type InMemoryBlobStore struct {
+	mu      sync.RWMutex
+	actions map[string]*remoteexecution.ActionResult
+	blobs   map[string][]byte
+}
+
+var _ BlobStore = (*InMemoryBlobStore)(nil)
+
+func NewInMemoryBlobStore() *InMemoryBlobStore {
+	return &InMemoryBlobStore{
+		actions: make(map[string]*remoteexecution.ActionResult),
+		blobs:   make(map[string][]byte),
+	}
+}
+
+func (s *InMemoryBlobStore) GetActionResult(_ context.Context, hash string) (*remoteexecution.ActionResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if ar, ok := s.actions[hash]; ok {
+		return ar, nil
+	}
+	return nil, status.Error(codes.NotFound, "action result not found")
+}
+
+func (s *InMemoryBlobStore) UpdateActionResult(_ context.Context, hash string, ar *remoteexecution.ActionResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.actions[hash] = ar
+	return nil
+}
+
+func (s *InMemoryBlobStore) lookup(hash string, size int64) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, ok := s.blobs[hash]
+	return data, ok && int64(len(data)) == size
+}
+
+func (s *InMemoryBlobStore) FindBlob(_ context.Context, hash string, size int64) (bool, error) {
+	_, ok := s.lookup(hash, size)
+	return ok, nil
+}
+
+func (s *InMemoryBlobStore) ReadBlob(_ context.Context, hash string, size int64, w io.Writer) error {
+	data, ok := s.lookup(hash, size)
+	if !ok {
+		return status.Error(codes.NotFound, "blob not found")
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func (s *InMemoryBlobStore) WriteBlob(_ context.Context, hash string, size int64, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
 	}
+	if fmt.Sprintf("%x", sha256.Sum256(data)) != hash || (size >= 0 && int64(len(data)) != size) {
+		return ErrDigestMismatch
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return nil, status.Error(codes.NotFound, "artifact not found")
+	s.blobs[hash] = data
+	return nil
 }
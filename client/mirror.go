@@ -0,0 +1,236 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Southclaws/fault"
+	"github.com/Southclaws/fault/fctx"
+	"github.com/Southclaws/fault/fmsg"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// maxConcurrentShadowReads limits the number of reads compared with the secondary cache at the same time.
+const maxConcurrentShadowReads = 4
+
+// Discrepancies between the caches found by MirrorClient, as counted by MirrorClient.Counts and reported in the
+// "kind" field of mirrorReport entries.
+const (
+	// The secondary cache doesn't have an artifact read from the primary
+	mirrorMiss = "miss"
+	// The secondary cache returned different content
+	mirrorContentMismatch = "content_mismatch"
+	// The secondary cache returned different metadata
+	mirrorMetadataMismatch = "metadata_mismatch"
+	// Reading from the secondary cache failed
+	mirrorReadError = "read_error"
+	// Writing to the secondary cache failed
+	mirrorWriteError = "write_error"
+
+	// mirrorChecked counts the reads compared with the secondary cache.
+	mirrorChecked = "checked"
+)
+
+// mirrorReport is a line of the mirror report, see NewMirrorClient.
+type mirrorReport struct {
+	Time time.Time `json:"time"`
+	Key  string    `json:"key"`
+	Kind string    `json:"kind"`
+
+	Error string `json:"error,omitempty"`
+	// SHA-256 of the content, for content mismatches
+	PrimarySHA256   string `json:"primarySha256,omitempty"`
+	SecondarySHA256 string `json:"secondarySha256,omitempty"`
+	// For metadata mismatches
+	PrimaryMetadata   Metadata `json:"primaryMetadata,omitempty"`
+	SecondaryMetadata Metadata `json:"secondaryMetadata,omitempty"`
+}
+
+// MirrorClient writes every artifact to a primary and a secondary cache, e.g. the old and the new one while
+// migrating between them. Reads are served from the primary only, and repeated on the secondary in the background
+// to find the artifacts it misses or returns differently.
+type MirrorClient struct {
+	primary, secondary Interface
+
+	shadowReads *backgroundTasks
+
+	mu     sync.Mutex
+	counts map[string]int
+	report *json.Encoder
+}
+
+var _ Interface = (*MirrorClient)(nil)
+
+// NewMirrorClient instantiates a client mirroring primary to secondary. If report is not nil, every discrepancy is
+// written to it as a JSON line (see mirrorReport).
+func NewMirrorClient(primary, secondary Interface, report io.Writer) *MirrorClient {
+	c := &MirrorClient{
+		primary:     primary,
+		secondary:   secondary,
+		shadowReads: newBackgroundTasks(maxConcurrentShadowReads),
+		counts:      make(map[string]int),
+	}
+	if report != nil {
+		c.report = json.NewEncoder(report)
+	}
+	return c
+}
+
+// CheckCapabilities checks both caches.
+func (c *MirrorClient) CheckCapabilities(ctx context.Context) error {
+	if err := c.primary.CheckCapabilities(ctx); err != nil {
+		return err
+	}
+	return fault.Wrap(c.secondary.CheckCapabilities(ctx), fmsg.With("secondary cache"))
+}
+
+// UploadFile uploads the file to both caches. Only errors of the primary are returned; failures of the secondary
+// are reported as discrepancies.
+func (c *MirrorClient) UploadFile(ctx context.Context, key, filePath string, metadata Metadata) error {
+	if err := c.primary.UploadFile(ctx, key, filePath, metadata); err != nil {
+		return err
+	}
+	if err := c.secondary.UploadFile(ctx, key, filePath, metadata); err != nil {
+		c.record(mirrorReport{Key: key, Kind: mirrorWriteError, Error: err.Error()})
+	}
+	return nil
+}
+
+// UploadReader spools the content to a temp file, which is then uploaded to both caches, see UploadFile.
+func (c *MirrorClient) UploadReader(ctx context.Context, key string, r io.Reader, size int64, digest string, metadata Metadata) error {
+	if size >= 0 && digest != "" {
+		r = newDigestVerifier(r, &remoteexecution.Digest{Hash: digest, SizeBytes: size})
+	}
+	path, err := spoolFile(r)
+	if err != nil {
+		return fault.Wrap(err, fctx.With(ctx))
+	}
+	defer func() { _ = os.Remove(path) }()
+
+	return c.UploadFile(ctx, key, path, metadata)
+}
+
+func (c *MirrorClient) FindFile(ctx context.Context, key string) (bool, error) {
+	return c.primary.FindFile(ctx, key)
+}
+
+func (c *MirrorClient) StatFile(ctx context.Context, key string) (ArtifactInfo, error) {
+	return c.primary.StatFile(ctx, key)
+}
+
+func (c *MirrorClient) StatFiles(ctx context.Context, keys []string) (map[string]ArtifactInfo, error) {
+	return c.primary.StatFiles(ctx, keys)
+}
+
+func (c *MirrorClient) DownloadFile(ctx context.Context, key string, w io.Writer) (Metadata, error) {
+	return downloadFile(ctx, c, key, w)
+}
+
+// StreamFile streams the artifact from the primary cache. Once it's done, the artifact is downloaded from the
+// secondary cache in the background and compared.
+func (c *MirrorClient) StreamFile(ctx context.Context, key string, open OpenFunc) error {
+	var (
+		h  = sha256.New()
+		md Metadata
+	)
+	err := c.primary.StreamFile(ctx, key, func(info ArtifactInfo) (io.Writer, error) {
+		md = info.Metadata
+		w, err := open(info)
+		if err != nil {
+			return nil, err
+		}
+		return io.MultiWriter(w, h), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.shadowRead(key, hex.EncodeToString(h.Sum(nil)), md)
+	return nil
+}
+
+// shadowRead downloads the artifact from the secondary cache in the background and compares it with the content
+// hash and metadata returned by the primary.
+func (c *MirrorClient) shadowRead(key, primarySHA256 string, primaryMD Metadata) {
+	c.shadowReads.run(func(ctx context.Context) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		h := sha256.New()
+		md, err := c.secondary.DownloadFile(ctx, key, h)
+		secondarySHA256 := hex.EncodeToString(h.Sum(nil))
+		switch {
+		case ctx.Err() != nil:
+			// aborted by Flush
+			return
+		case isNotFound(err):
+			c.record(mirrorReport{Key: key, Kind: mirrorMiss})
+		case err != nil:
+			c.record(mirrorReport{Key: key, Kind: mirrorReadError, Error: err.Error()})
+		case secondarySHA256 != primarySHA256:
+			c.record(mirrorReport{
+				Key: key, Kind: mirrorContentMismatch, PrimarySHA256: primarySHA256, SecondarySHA256: secondarySHA256,
+			})
+		case !sameMetadata(primaryMD, md):
+			c.record(mirrorReport{
+				Key: key, Kind: mirrorMetadataMismatch, PrimaryMetadata: primaryMD, SecondaryMetadata: md,
+			})
+		}
+
+		c.mu.Lock()
+		c.counts[mirrorChecked]++
+		c.mu.Unlock()
+	})
+}
+
+// record counts the discrepancy and writes it to the report.
+func (c *MirrorClient) record(r mirrorReport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.counts[r.Kind]++
+	if c.report != nil {
+		r.Time = time.Now().UTC()
+		// The report is best effort.
+		_ = c.report.Encode(r)
+	}
+}
+
+// Flush waits for the pending shadow reads to finish. If ctx is done first, they are aborted.
+func (c *MirrorClient) Flush(ctx context.Context) error {
+	return c.shadowReads.flush(ctx)
+}
+
+// Counts returns the number of discrepancies by kind, and the number of reads compared ("checked").
+func (c *MirrorClient) Counts() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := map[string]int{mirrorChecked: c.counts[mirrorChecked]}
+	for kind, n := range c.counts {
+		counts[kind] = n
+	}
+	return counts
+}
+
+// sameMetadata compares metadata by the string form of the values, as backends don't necessarily keep their types.
+func sameMetadata(a, b Metadata) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		w, ok := b[k]
+		if !ok || fmt.Sprint(v) != fmt.Sprint(w) {
+			return false
+		}
+	}
+	return true
+}
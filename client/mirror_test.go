@@ -0,0 +1,96 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// readOnlyClient rejects uploads, like a cache the credentials can't write to.
+type readOnlyClient struct {
+	Interface
+}
+
+func (readOnlyClient) UploadFile(context.Context, string, string, Metadata) error {
+	return errors.New("read-only cache")
+}
+
+func TestMirrorClient(t *testing.T) {
+	var (
+		ctx       = context.Background()
+		primary   = NewInMemoryClient()
+		secondary = NewInMemoryClient()
+		report    bytes.Buffer
+	)
+	cl := NewMirrorClient(primary, secondary, &report)
+	assert.NilError(t, cl.CheckCapabilities(ctx))
+
+	downloadAndUpload(ctx, t, cl, Metadata{"x-artifact-duration": "42"})
+	uploadReaderAndDownload(ctx, t, cl, 4096, false)
+	uploadReaderAndDownload(ctx, t, cl, 4096, true)
+	assert.NilError(t, cl.Flush(ctx))
+	assert.DeepEqual(t, cl.Counts(), map[string]int{mirrorChecked: 3})
+	assert.Equal(t, report.Len(), 0)
+
+	t.Run("dual write", func(t *testing.T) {
+		assert.NilError(t, cl.UploadReader(ctx, "both", strings.NewReader("DATA"), 4, "", nil))
+
+		for _, c := range []Interface{primary, secondary} {
+			ok, err := c.FindFile(ctx, "both")
+			assert.NilError(t, err)
+			assert.Assert(t, ok)
+		}
+	})
+
+	t.Run("discrepancies", func(t *testing.T) {
+		report.Reset()
+		for key, content := range map[string]string{"missing": "DATA", "content": "DATA", "metadata": "DATA"} {
+			assert.NilError(t, primary.UploadReader(ctx, key, strings.NewReader(content), 4, "", Metadata{"k": "v"}))
+		}
+		assert.NilError(t, secondary.UploadReader(ctx, "content", strings.NewReader("XXXX"), 4, "", Metadata{"k": "v"}))
+		assert.NilError(t, secondary.UploadReader(ctx, "metadata", strings.NewReader("DATA"), 4, "", Metadata{"k": "w"}))
+
+		for _, key := range []string{"missing", "content", "metadata", "both"} {
+			var buf bytes.Buffer
+			_, err := cl.DownloadFile(ctx, key, &buf)
+			assert.NilError(t, err)
+			assert.Equal(t, buf.String(), "DATA")
+		}
+		assert.NilError(t, cl.Flush(ctx))
+
+		counts := cl.Counts()
+		assert.Equal(t, counts[mirrorChecked], 7)
+		assert.Equal(t, counts[mirrorMiss], 1)
+		assert.Equal(t, counts[mirrorContentMismatch], 1)
+		assert.Equal(t, counts[mirrorMetadataMismatch], 1)
+
+		reports := make(map[string]mirrorReport)
+		dec := json.NewDecoder(&report)
+		for dec.More() {
+			var r mirrorReport
+			assert.NilError(t, dec.Decode(&r))
+			reports[r.Key] = r
+		}
+		assert.Equal(t, len(reports), 3)
+		assert.Equal(t, reports["missing"].Kind, mirrorMiss)
+		assert.Equal(t, reports["content"].Kind, mirrorContentMismatch)
+		assert.Assert(t, reports["content"].PrimarySHA256 != reports["content"].SecondarySHA256)
+		assert.Equal(t, reports["metadata"].Kind, mirrorMetadataMismatch)
+		assert.DeepEqual(t, reports["metadata"].SecondaryMetadata, Metadata{"k": "w"})
+	})
+
+	t.Run("secondary write failure", func(t *testing.T) {
+		cl := NewMirrorClient(primary, readOnlyClient{secondary}, nil)
+		assert.NilError(t, cl.UploadReader(ctx, "primary only", strings.NewReader("DATA"), 4, "", nil))
+		assert.Equal(t, cl.Counts()[mirrorWriteError], 1)
+
+		ok, err := primary.FindFile(ctx, "primary only")
+		assert.NilError(t, err)
+		assert.Assert(t, ok)
+	})
+}
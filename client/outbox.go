@@ -0,0 +1,237 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Southclaws/fault"
+	"github.com/Southclaws/fault/fctx"
+	"github.com/Southclaws/fault/fmsg"
+)
+
+// outboxAttempts is the number of upload attempts per entry during a single Replay.
+const outboxAttempts = 3
+
+// outboxInitialBackoff is the delay before the second attempt; it doubles after every attempt.
+var outboxInitialBackoff = time.Second
+
+// Outbox keeps uploads that failed or have not finished in a directory, so that they can be retried later,
+// possibly by another process.
+//
+// Every entry is a pair of files: <id>.data holds the artifact, and <id>.json holds its key and metadata.
+// The .json file is written last, so a .data file without one is an entry that is still being written.
+// The .data file is locked by the process that created the entry until the entry is discarded or released, so
+// that Replay doesn't pick up uploads still in flight.
+type Outbox struct {
+	dir string
+}
+
+// outboxRecord is the content of <id>.json.
+type outboxRecord struct {
+	Key      string   `json:"key"`
+	Metadata Metadata `json:"metadata,omitempty"`
+}
+
+// NewOutbox creates an outbox in dir.
+func NewOutbox(dir string) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fault.Wrap(err, fmsg.With("error creating outbox directory"))
+	}
+	return &Outbox{dir: dir}, nil
+}
+
+// OutboxEntry is an outbox entry being written.
+type OutboxEntry struct {
+	f   *os.File
+	n   int64
+	err error
+}
+
+// Create starts writing a new entry. It stays locked until Discard or Release is called.
+func (o *Outbox) Create() (*OutboxEntry, error) {
+	f, err := os.CreateTemp(o.dir, "*.data")
+	if err != nil {
+		return nil, fault.Wrap(err, fmsg.With("error creating outbox entry"))
+	}
+	// nobody else can hold the lock of a new file
+	if _, err = tryLock(f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, fault.Wrap(err, fmsg.With("error locking outbox entry"))
+	}
+	return &OutboxEntry{f: f}, nil
+}
+
+// Write never fails, so that an entry can be fed with io.TeeReader without affecting the main stream.
+// Write errors are reported by Commit.
+func (e *OutboxEntry) Write(b []byte) (int, error) {
+	if e.err == nil {
+		var n int
+		n, e.err = e.f.Write(b)
+		e.n += int64(n)
+	}
+	return len(b), nil
+}
+
+// Size returns the number of bytes written so far.
+func (e *OutboxEntry) Size() int64 {
+	return e.n
+}
+
+// DataPath returns the path of the file holding the artifact.
+func (e *OutboxEntry) DataPath() string {
+	return e.f.Name()
+}
+
+// Commit makes the entry durable, so that Replay will pick it up once the entry is released (or the process exits).
+func (e *OutboxEntry) Commit(key string, metadata Metadata) error {
+	if e.err != nil {
+		return fault.Wrap(e.err, fmsg.With("error writing outbox entry"))
+	}
+	if err := e.f.Sync(); err != nil {
+		return fault.Wrap(err, fmsg.With("error writing outbox entry"))
+	}
+
+	data, err := json.Marshal(outboxRecord{Key: key, Metadata: metadata})
+	if err != nil {
+		return fault.Wrap(err, fmsg.With("error encoding outbox entry"))
+	}
+
+	recordPath := recordPathFor(e.f.Name())
+	tmp := recordPath + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return fault.Wrap(err, fmsg.With("error writing outbox entry"))
+	}
+	return fault.Wrap(os.Rename(tmp, recordPath), fmsg.With("error writing outbox entry"))
+}
+
+// Discard removes the entry.
+func (e *OutboxEntry) Discard() {
+	// remove the files before unlocking, so that Replay can't pick up the entry in between
+	_ = os.Remove(recordPathFor(e.f.Name()))
+	_ = os.Remove(e.f.Name())
+	_ = e.f.Close()
+}
+
+// Release unlocks a committed entry, leaving it to Replay.
+func (e *OutboxEntry) Release() {
+	_ = e.f.Close()
+}
+
+func recordPathFor(dataPath string) string {
+	return strings.TrimSuffix(dataPath, ".data") + ".json"
+}
+
+// Replay uploads all committed entries to cl, retrying every entry with backoff, and removes the uploaded
+// ones. onResult is called with the outcome for every entry. Entries that are still locked by their creator are
+// skipped. If another process is replaying the outbox, Replay does nothing.
+func (o *Outbox) Replay(ctx context.Context, cl Interface, onResult func(key string, err error)) error {
+	unlock, ok, err := tryLockFile(filepath.Join(o.dir, ".lock"))
+	if err != nil {
+		return fault.Wrap(err, fmsg.With("error locking outbox"), fctx.With(ctx))
+	}
+	if !ok {
+		return nil
+	}
+	defer unlock()
+
+	o.removeOrphans()
+
+	records, err := filepath.Glob(filepath.Join(o.dir, "*.json"))
+	if err != nil {
+		return fault.Wrap(err, fctx.With(ctx))
+	}
+	for _, recordPath := range records {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		key, err := o.replayEntry(ctx, cl, recordPath)
+		if key != "" {
+			onResult(key, err)
+		}
+	}
+	return nil
+}
+
+// replayEntry uploads a single entry. key is empty if the entry is gone, unreadable, or locked.
+func (o *Outbox) replayEntry(ctx context.Context, cl Interface, recordPath string) (key string, err error) {
+	dataPath := strings.TrimSuffix(recordPath, ".json") + ".data"
+	// A missing data file is reported by the upload below.
+	if f, err := os.Open(dataPath); err == nil {
+		defer func() { _ = f.Close() }()
+		if ok, err := tryLock(f); !ok {
+			return "", err
+		}
+	}
+
+	data, err := os.ReadFile(recordPath)
+	if err != nil {
+		return "", err
+	}
+	var record outboxRecord
+	if err = json.Unmarshal(data, &record); err != nil {
+		// a corrupt entry would never be uploaded
+		_ = os.Remove(recordPath)
+		return "", err
+	}
+
+	ctx = fctx.WithMeta(ctx, "key", record.Key)
+	backoff := outboxInitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		if err = cl.UploadFile(ctx, record.Key, dataPath, record.Metadata); err == nil {
+			_ = os.Remove(recordPath)
+			_ = os.Remove(dataPath)
+			return record.Key, nil
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			_ = os.Remove(recordPath)
+			return record.Key, err
+		}
+		if attempt == outboxAttempts {
+			return record.Key, err
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return record.Key, err
+		}
+	}
+}
+
+// removeOrphans removes data files left by processes that died before committing their entries.
+func (o *Outbox) removeOrphans() {
+	dataFiles, err := filepath.Glob(filepath.Join(o.dir, "*.data"))
+	if err != nil {
+		return
+	}
+	for _, dataPath := range dataFiles {
+		if _, err = os.Stat(recordPathFor(dataPath)); !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if fi, err := os.Stat(dataPath); err == nil && time.Since(fi.ModTime()) > staleTmpAge {
+			o.removeUnlocked(dataPath)
+		}
+	}
+}
+
+// removeUnlocked removes the data file unless its entry is still being written.
+func (o *Outbox) removeUnlocked(dataPath string) {
+	f, err := os.Open(dataPath)
+	if err != nil {
+		return
+	}
+	defer func() { _ = f.Close() }()
+	if ok, _ := tryLock(f); ok {
+		_ = os.Remove(dataPath)
+	}
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestOutbox(t *testing.T) {
+	outboxInitialBackoff = time.Millisecond
+	ctx := context.Background()
+
+	addEntry := func(t *testing.T, o *Outbox, key string, data []byte, md Metadata) {
+		e, err := o.Create()
+		assert.NilError(t, err)
+		_, _ = e.Write(data)
+		assert.Equal(t, e.Size(), int64(len(data)))
+		assert.NilError(t, e.Commit(key, md))
+		e.Release()
+	}
+	countEntries := func(t *testing.T, o *Outbox) int {
+		records, err := filepath.Glob(filepath.Join(o.dir, "*.json"))
+		assert.NilError(t, err)
+		return len(records)
+	}
+
+	t.Run("uploads and removes committed entries", func(t *testing.T) {
+		o, err := NewOutbox(t.TempDir())
+		assert.NilError(t, err)
+
+		addEntry(t, o, "key1", []byte("DATA1"), Metadata{"x-artifact-duration": "42"})
+		addEntry(t, o, "key2", []byte("DATA2"), nil)
+		// not committed, so it is still being written
+		pending, err := o.Create()
+		assert.NilError(t, err)
+		_, _ = pending.Write([]byte("PENDING"))
+
+		cl := NewInMemoryClient()
+		results := map[string]error{}
+		assert.NilError(t, o.Replay(ctx, cl, func(key string, err error) { results[key] = err }))
+		assert.DeepEqual(t, results, map[string]error{"key1": nil, "key2": nil})
+		assert.Equal(t, countEntries(t, o), 0)
+
+		var buf bytes.Buffer
+		md, err := cl.DownloadFile(ctx, "key1", &buf)
+		assert.NilError(t, err)
+		assert.Equal(t, buf.String(), "DATA1")
+		assert.DeepEqual(t, md, Metadata{"x-artifact-duration": "42"})
+
+		pending.Discard()
+	})
+
+	t.Run("keeps entries that fail to upload", func(t *testing.T) {
+		o, err := NewOutbox(t.TempDir())
+		assert.NilError(t, err)
+		addEntry(t, o, "key", []byte("DATA"), nil)
+
+		cl := &failingUploadClient{InMemoryClient: NewInMemoryClient()}
+		var failed []string
+		assert.NilError(t, o.Replay(ctx, cl, func(key string, err error) {
+			assert.Assert(t, err != nil)
+			failed = append(failed, key)
+		}))
+		assert.DeepEqual(t, failed, []string{"key"})
+		assert.Equal(t, cl.attempts, outboxAttempts)
+		assert.Equal(t, countEntries(t, o), 1)
+
+		// the next replay succeeds
+		assert.NilError(t, o.Replay(ctx, cl.InMemoryClient, func(string, error) {}))
+		assert.Equal(t, countEntries(t, o), 0)
+	})
+
+	t.Run("skips entries in flight", func(t *testing.T) {
+		o, err := NewOutbox(t.TempDir())
+		assert.NilError(t, err)
+
+		e, err := o.Create()
+		assert.NilError(t, err)
+		_, _ = e.Write([]byte("DATA"))
+		assert.NilError(t, e.Commit("key", nil))
+
+		cl := NewInMemoryClient()
+		var results []string
+		assert.NilError(t, o.Replay(ctx, cl, func(key string, _ error) { results = append(results, key) }))
+		assert.Equal(t, len(results), 0)
+		assert.Equal(t, countEntries(t, o), 1)
+
+		e.Release()
+		assert.NilError(t, o.Replay(ctx, cl, func(key string, _ error) { results = append(results, key) }))
+		assert.DeepEqual(t, results, []string{"key"})
+		assert.Equal(t, countEntries(t, o), 0)
+	})
+
+	t.Run("discard", func(t *testing.T) {
+		o, err := NewOutbox(t.TempDir())
+		assert.NilError(t, err)
+
+		e, err := o.Create()
+		assert.NilError(t, err)
+		_, _ = e.Write([]byte("DATA"))
+		assert.NilError(t, e.Commit("key", nil))
+		e.Discard()
+
+		assert.Equal(t, countEntries(t, o), 0)
+		files, err := filepath.Glob(filepath.Join(o.dir, "*.data"))
+		assert.NilError(t, err)
+		assert.Equal(t, len(files), 0)
+	})
+}
+
+type failingUploadClient struct {
+	*InMemoryClient
+	attempts int
+}
+
+func (c *failingUploadClient) UploadFile(context.Context, string, string, Metadata) error {
+	c.attempts++
+	return errors.New("remote cache is down")
+}
+
+func (c *failingUploadClient) UploadReader(context.Context, string, io.Reader, int64, string, Metadata) error {
+	c.attempts++
+	return errors.New("remote cache is down")
+}
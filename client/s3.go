@@ -0,0 +1,335 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Southclaws/fault"
+	"github.com/Southclaws/fault/fctx"
+	"github.com/Southclaws/fault/fmsg"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// s3PartSize is the part size of multipart uploads. Smaller artifacts are uploaded with a single request.
+var s3PartSize = 16 * 1024 * 1024
+
+// s3MetadataPrefix prefixes the headers of object metadata.
+const s3MetadataPrefix = "X-Amz-Meta-"
+
+// S3Options configure a client for S3-compatible object storage.
+type S3Options struct {
+	Bucket string
+	// Prepended to object keys, e.g. "tbc/"
+	Prefix string
+	Region string
+	// Endpoint of S3-compatible storage, e.g. http://localhost:9000 for MinIO. Objects are addressed path-style
+	// there. If empty, the AWS endpoint of Region is used.
+	Endpoint string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// s3Client stores every artifact as an object named by Prefix and the key. Metadata is kept as object metadata,
+// so its values are stored as strings.
+type s3Client struct {
+	opts  S3Options
+	creds s3Credentials
+	// baseURL addresses the bucket
+	baseURL *url.URL
+	hc      *http.Client
+}
+
+var _ Interface = (*s3Client)(nil)
+
+// NewS3Client instantiates a client for an S3 bucket.
+func NewS3Client(opts S3Options) (Interface, error) {
+	if opts.Bucket == "" {
+		return nil, fault.New("S3 bucket is not set")
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	if (opts.AccessKeyID == "") != (opts.SecretAccessKey == "") {
+		return nil, fault.New("both S3 access key ID and secret access key must be set")
+	}
+
+	var (
+		baseURL *url.URL
+		err     error
+	)
+	if opts.Endpoint != "" {
+		if baseURL, err = url.Parse(strings.TrimSuffix(opts.Endpoint, "/") + "/" + opts.Bucket); err != nil {
+			return nil, fault.Wrap(err, fmsg.With("invalid S3 endpoint"))
+		}
+	} else {
+		baseURL = &url.URL{Scheme: "https", Host: fmt.Sprintf("%s.s3.%s.amazonaws.com", opts.Bucket, opts.Region)}
+	}
+
+	return &s3Client{
+		opts:    opts,
+		creds:   s3Credentials{opts.AccessKeyID, opts.SecretAccessKey, opts.SessionToken},
+		baseURL: baseURL,
+		hc:      &http.Client{},
+	}, nil
+}
+
+// CheckCapabilities checks that the bucket exists and is accessible.
+func (c *s3Client) CheckCapabilities(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodHead, "", nil, nil, nil, 0)
+	if err != nil {
+		return fault.Wrap(err, fmsg.With("HeadBucket failed"), fctx.With(ctx))
+	}
+	return resp.Body.Close()
+}
+
+func (c *s3Client) UploadFile(ctx context.Context, key, filePath string, metadata Metadata) error {
+	return uploadFileViaReader(ctx, c, key, filePath, metadata)
+}
+
+// UploadReader uploads artifacts larger than s3PartSize (or of unknown size) with multipart upload, so that
+// they don't have to be spooled.
+func (c *s3Client) UploadReader(ctx context.Context, key string, r io.Reader, size int64, digest string, metadata Metadata) error {
+	if size >= 0 && digest != "" {
+		r = newDigestVerifier(r, &remoteexecution.Digest{Hash: digest, SizeBytes: size})
+	}
+
+	if size >= 0 && size <= int64(s3PartSize) {
+		return c.putObject(ctx, key, r, size, metadata)
+	}
+
+	// Read the first part to find out whether the artifact is large enough for multipart upload. The buffer grows
+	// as it's filled, so that small artifacts of unknown size don't cost a whole part.
+	var first bytes.Buffer
+	n, err := first.ReadFrom(io.LimitReader(r, int64(s3PartSize)))
+	if err != nil {
+		return fault.Wrap(err, fmsg.With("error reading upload"), fctx.With(ctx))
+	}
+	if n < int64(s3PartSize) {
+		return c.putObject(ctx, key, &first, n, metadata)
+	}
+	return c.multipartUpload(ctx, key, first.Bytes(), r, metadata)
+}
+
+func (c *s3Client) putObject(ctx context.Context, key string, r io.Reader, size int64, metadata Metadata) error {
+	resp, err := c.do(ctx, http.MethodPut, key, nil, metadataHeaders(metadata), r, size)
+	if err != nil {
+		return fault.Wrap(err, fmsg.With("PutObject failed"), fctx.With(ctx))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// multipartUpload uploads buf, which holds the first part, followed by the rest of r. buf is reused for the
+// following parts. The upload is aborted on failure, so that the storage isn't billed for orphaned parts.
+func (c *s3Client) multipartUpload(ctx context.Context, key string, buf []byte, r io.Reader, metadata Metadata) (err error) {
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err = c.doXML(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, metadataHeaders(metadata), nil, &initiated); err != nil {
+		return fault.Wrap(err, fmsg.With("CreateMultipartUpload failed"), fctx.With(ctx))
+	}
+	uploadQuery := url.Values{"uploadId": {initiated.UploadID}}
+
+	defer func() {
+		if err != nil {
+			if resp, abortErr := c.do(context.WithoutCancel(ctx), http.MethodDelete, key, uploadQuery, nil, nil, 0); abortErr == nil {
+				_ = resp.Body.Close()
+			}
+		}
+	}()
+
+	var (
+		parts []s3CompletedPart
+		part  = buf
+	)
+	for len(part) > 0 {
+		partNumber := len(parts) + 1
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {initiated.UploadID}}
+
+		var resp *http.Response
+		if resp, err = c.do(ctx, http.MethodPut, key, query, nil, bytes.NewReader(part), int64(len(part))); err != nil {
+			return fault.Wrap(err, fmsg.With(fmt.Sprintf("UploadPart %d failed", partNumber)), fctx.With(ctx))
+		}
+		_ = resp.Body.Close()
+		parts = append(parts, s3CompletedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+
+		var n int
+		n, err = io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		} else if err != nil {
+			return fault.Wrap(err, fmsg.With("error reading upload"), fctx.With(ctx))
+		}
+		part = buf[:n]
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return fault.Wrap(err, fmsg.With("marshaling failed"), fctx.With(ctx))
+	}
+	var completed struct {
+		XMLName xml.Name
+	}
+	if err = c.doXML(ctx, http.MethodPost, key, uploadQuery, nil, body, &completed); err != nil {
+		return fault.Wrap(err, fmsg.With("CompleteMultipartUpload failed"), fctx.With(ctx))
+	}
+	// CompleteMultipartUpload can fail after responding with 200
+	if completed.XMLName.Local == "Error" {
+		return fault.Wrap(fault.New("CompleteMultipartUpload failed"), fctx.With(ctx))
+	}
+	return nil
+}
+
+// FindFile uses HeadObject to check if the artifact exists.
+func (c *s3Client) FindFile(ctx context.Context, key string) (bool, error) {
+	if _, err := c.StatFile(ctx, key); err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *s3Client) StatFile(ctx context.Context, key string) (ArtifactInfo, error) {
+	resp, err := c.do(ctx, http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return ArtifactInfo{}, fault.Wrap(err, fmsg.With("HeadObject failed"), fctx.With(ctx))
+	}
+	_ = resp.Body.Close()
+	return ArtifactInfo{Size: resp.ContentLength, Metadata: metadataFromHeaders(resp.Header)}, nil
+}
+
+func (c *s3Client) StatFiles(ctx context.Context, keys []string) (map[string]ArtifactInfo, error) {
+	return statConcurrently(ctx, keys, c.StatFile)
+}
+
+func (c *s3Client) DownloadFile(ctx context.Context, key string, w io.Writer) (Metadata, error) {
+	return downloadFile(ctx, c, key, w)
+}
+
+func (c *s3Client) StreamFile(ctx context.Context, key string, open OpenFunc) error {
+	resp, err := c.do(ctx, http.MethodGet, key, nil, nil, nil, 0)
+	if err != nil {
+		return fault.Wrap(err, fmsg.With("GetObject failed"), fctx.With(ctx))
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	w, err := open(ArtifactInfo{Size: max(resp.ContentLength, UnknownSize), Metadata: metadataFromHeaders(resp.Header)})
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		return fault.Wrap(err, fmsg.With("error reading object"), fctx.With(ctx))
+	}
+	return nil
+}
+
+func metadataHeaders(metadata Metadata) http.Header {
+	h := make(http.Header, len(metadata))
+	for k, v := range metadata {
+		h.Set(s3MetadataPrefix+k, fmt.Sprint(v))
+	}
+	return h
+}
+
+// metadataFromHeaders restores metadata stored by metadataHeaders. S3 doesn't preserve the case of the keys,
+// so they are lowercased.
+func metadataFromHeaders(h http.Header) (md Metadata) {
+	for name, values := range h {
+		if k, ok := strings.CutPrefix(name, s3MetadataPrefix); ok && len(values) > 0 {
+			if md == nil {
+				md = make(Metadata)
+			}
+			md[strings.ToLower(k)] = values[0]
+		}
+	}
+	return
+}
+
+// doXML sends the request with an XML body and decodes the XML response into result.
+func (c *s3Client) doXML(ctx context.Context, method, key string, query url.Values, h http.Header, body []byte, result any) error {
+	if body != nil {
+		if h == nil {
+			h = make(http.Header)
+		}
+		h.Set("Content-Type", "application/xml")
+	}
+	resp, err := c.do(ctx, method, key, query, h, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	return fault.Wrap(xml.NewDecoder(resp.Body).Decode(result), fmsg.With("error decoding response"))
+}
+
+// do sends a signed request for the object with key (or the bucket, if key is empty). Unsuccessful responses
+// are returned as errors, 404 as a NotFound status error.
+func (c *s3Client) do(
+	ctx context.Context, method, key string, query url.Values, h http.Header, body io.Reader, size int64,
+) (*http.Response, error) {
+	u := *c.baseURL
+	if key != "" {
+		objectKey := c.opts.Prefix + key
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + objectKey
+		u.RawPath = strings.TrimSuffix(u.EscapedPath(), "/") + "/" + s3Escape(objectKey, true)
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+
+	if body == nil || size == 0 {
+		body = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, fault.Wrap(err, fmsg.With("error creating request"))
+	}
+	req.ContentLength = size
+	for name, values := range h {
+		req.Header[name] = values
+	}
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	if c.creds.accessKeyID != "" {
+		c.creds.sign(req, c.opts.Region, time.Now())
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, fault.Wrap(err, fmsg.With(method+" "+u.Redacted()+" failed"))
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotFound {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, status.Error(codes.NotFound, "object not found")
+	}
+
+	var s3Err struct {
+		Code, Message string
+	}
+	_ = xml.NewDecoder(resp.Body).Decode(&s3Err)
+	return nil, fault.New(fmt.Sprintf("%s %s: %s %s %s", method, u.Redacted(), resp.Status, s3Err.Code, s3Err.Message))
+}
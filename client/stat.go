@@ -0,0 +1,67 @@
+package client
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxConcurrentLookups limits the number of lookups issued concurrently by statConcurrently.
+const maxConcurrentLookups = 16
+
+// statConcurrently calls stat for every key using a bounded number of goroutines. Keys that are not found are
+// omitted from the result; any other error cancels the remaining lookups and is returned.
+func statConcurrently(
+	ctx context.Context,
+	keys []string,
+	stat func(ctx context.Context, key string) (ArtifactInfo, error),
+) (map[string]ArtifactInfo, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		result   = make(map[string]ArtifactInfo, len(keys))
+		firstErr error
+		sem      = make(chan struct{}, maxConcurrentLookups)
+	)
+	for _, key := range keys {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(key string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			info, err := stat(ctx, key)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch {
+			case err == nil:
+				result[key] = info
+			case isNotFound(err):
+			case firstErr == nil:
+				firstErr = err
+				cancel()
+			}
+		}(key)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return result, nil
+}
+
+func isNotFound(err error) bool {
+	s, ok := status.FromError(err)
+	return ok && s.Code() == codes.NotFound
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gotest.tools/v3/assert"
+)
+
+func TestStatConcurrently(t *testing.T) {
+	var keys []string
+	for i := 0; i < 3*maxConcurrentLookups; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+	}
+
+	t.Run("missing keys are omitted", func(t *testing.T) {
+		result, err := statConcurrently(context.Background(), keys, func(_ context.Context, key string) (ArtifactInfo, error) {
+			if key == "key1" {
+				return ArtifactInfo{}, status.Error(codes.NotFound, "not found")
+			}
+			return ArtifactInfo{Size: int64(len(key))}, nil
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, len(result), len(keys)-1)
+		assert.Equal(t, result["key10"].Size, int64(5))
+
+		_, ok := result["key1"]
+		assert.Equal(t, ok, false)
+	})
+
+	t.Run("errors are propagated", func(t *testing.T) {
+		_, err := statConcurrently(context.Background(), keys, func(_ context.Context, key string) (ArtifactInfo, error) {
+			if key == "key1" {
+				return ArtifactInfo{}, errors.New("boom")
+			}
+			return ArtifactInfo{}, nil
+		})
+		assert.ErrorContains(t, err, "boom")
+	})
+}
@@ -0,0 +1,334 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/Southclaws/fault"
+	"github.com/Southclaws/fault/fctx"
+	"github.com/Southclaws/fault/fmsg"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxConcurrentPromotions limits the number of artifacts copied into higher tiers at the same time.
+const maxConcurrentPromotions = 4
+
+// Tier is a backend of a TieredClient.
+type Tier struct {
+	// Name of the tier in errors and statistics
+	Name   string
+	Client Interface
+	// If set, uploads and artifacts promoted from lower tiers are stored in this tier
+	Upload bool
+}
+
+// TieredClient looks artifacts up in an ordered list of tiers, e.g. a shared directory, a regional, and a global
+// cache. An artifact found in a lower tier is copied in the background into the higher tiers accepting uploads,
+// so that the next lookup is served by the fastest tier.
+type TieredClient struct {
+	tiers  []Tier
+	logger *slog.Logger
+
+	promotions *backgroundTasks
+
+	mu   sync.Mutex
+	hits map[string]int
+}
+
+var _ Interface = (*TieredClient)(nil)
+
+// NewTieredClient instantiates a client for tiers, starting with the one looked up first. Tier names must be unique.
+// Failed uploads that don't fail the whole upload are logged to logger, see UploadFile.
+func NewTieredClient(logger *slog.Logger, tiers []Tier) (*TieredClient, error) {
+	if len(tiers) == 0 {
+		return nil, fault.New("no cache tiers")
+	}
+	names := make(map[string]bool, len(tiers))
+	for _, t := range tiers {
+		if names[t.Name] {
+			return nil, fault.New("duplicate cache tier " + t.Name)
+		}
+		names[t.Name] = true
+	}
+
+	return &TieredClient{
+		tiers:      tiers,
+		logger:     logger,
+		promotions: newBackgroundTasks(maxConcurrentPromotions),
+		hits:       make(map[string]int),
+	}, nil
+}
+
+// CheckCapabilities checks every tier.
+func (c *TieredClient) CheckCapabilities(ctx context.Context) error {
+	for _, t := range c.tiers {
+		if err := t.Client.CheckCapabilities(ctx); err != nil {
+			return fault.Wrap(err, fmsg.With("cache tier "+t.Name))
+		}
+	}
+	return nil
+}
+
+// UploadFile uploads the file to every tier accepting uploads. Tiers that fail don't stop the upload to the others.
+// The upload only fails if the last tier (the one shared by everybody, e.g. the remote cache) fails, or if no tier
+// stores the artifact; the failures of the other tiers are just logged.
+func (c *TieredClient) UploadFile(ctx context.Context, key, filePath string, metadata Metadata) error {
+	return c.uploadFile(ctx, c.tiers, key, filePath, metadata)
+}
+
+// UploadReader uploads the content read from r, see UploadFile. Unless there is only one tier to upload to, the
+// content is spooled to a temp file first.
+func (c *TieredClient) UploadReader(ctx context.Context, key string, r io.Reader, size int64, digest string, metadata Metadata) error {
+	var upload []Tier
+	for _, t := range c.tiers {
+		if t.Upload {
+			upload = append(upload, t)
+		}
+	}
+	switch len(upload) {
+	case 0:
+		return nil
+	case 1:
+		return fault.Wrap(upload[0].Client.UploadReader(ctx, key, r, size, digest, metadata),
+			fmsg.With("cache tier "+upload[0].Name))
+	}
+
+	if size >= 0 && digest != "" {
+		r = newDigestVerifier(r, &remoteexecution.Digest{Hash: digest, SizeBytes: size})
+	}
+	path, err := spoolFile(r)
+	if err != nil {
+		return fault.Wrap(err, fctx.With(ctx))
+	}
+	defer func() { _ = os.Remove(path) }()
+
+	return c.uploadFile(ctx, upload, key, path, metadata)
+}
+
+// uploadFile uploads the file to the tiers accepting uploads among tiers, see UploadFile.
+func (c *TieredClient) uploadFile(ctx context.Context, tiers []Tier, key, filePath string, metadata Metadata) error {
+	var (
+		last   = c.tiers[len(c.tiers)-1].Name
+		errs   []error
+		failed bool
+		stored bool
+	)
+	for _, t := range tiers {
+		if !t.Upload {
+			continue
+		}
+		if err := t.Client.UploadFile(ctx, key, filePath, metadata); err != nil {
+			errs = append(errs, fault.Wrap(err, fmsg.With("cache tier "+t.Name)))
+			failed = failed || t.Name == last
+		} else {
+			stored = true
+		}
+	}
+	if failed || !stored {
+		return errors.Join(errs...)
+	}
+
+	for _, err := range errs {
+		c.logger.Warn("[tbc] upload to a cache tier failed", slog.String("key", key), slog.String("err", err.Error()))
+	}
+	return nil
+}
+
+func (c *TieredClient) FindFile(ctx context.Context, key string) (bool, error) {
+	if _, err := c.StatFile(ctx, key); err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// StatFile returns the artifact info from the first tier having the artifact. Tiers that fail are skipped; their
+// error is only returned if no other tier has the artifact.
+func (c *TieredClient) StatFile(ctx context.Context, key string) (ArtifactInfo, error) {
+	var firstErr error
+	for _, t := range c.tiers {
+		info, err := t.Client.StatFile(ctx, key)
+		switch {
+		case err == nil:
+			return info, nil
+		case !isNotFound(err) && firstErr == nil:
+			firstErr = fault.Wrap(err, fmsg.With("cache tier "+t.Name))
+		}
+	}
+	if firstErr != nil {
+		return ArtifactInfo{}, firstErr
+	}
+	return ArtifactInfo{}, status.Error(codes.NotFound, key+" not found in any cache tier")
+}
+
+// StatFiles looks up the keys tier by tier, each tier only getting the keys not found in the higher ones.
+func (c *TieredClient) StatFiles(ctx context.Context, keys []string) (map[string]ArtifactInfo, error) {
+	var (
+		result   = make(map[string]ArtifactInfo, len(keys))
+		misses   = keys
+		firstErr error
+	)
+	for _, t := range c.tiers {
+		infos, err := t.Client.StatFiles(ctx, misses)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fault.Wrap(err, fmsg.With("cache tier "+t.Name))
+			}
+			continue
+		}
+
+		var remaining []string
+		for _, key := range misses {
+			if info, ok := infos[key]; ok {
+				result[key] = info
+			} else {
+				remaining = append(remaining, key)
+			}
+		}
+		if misses = remaining; len(misses) == 0 {
+			return result, nil
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return result, nil
+}
+
+func (c *TieredClient) DownloadFile(ctx context.Context, key string, w io.Writer) (Metadata, error) {
+	return downloadFile(ctx, c, key, w)
+}
+
+// StreamFile streams the artifact from the first tier having it. A tier that fails before the artifact is found is
+// skipped, like in StatFile. If the artifact comes from a lower tier, it is promoted into the higher ones.
+func (c *TieredClient) StreamFile(ctx context.Context, key string, open OpenFunc) error {
+	var firstErr error
+	for i, t := range c.tiers {
+		opened, err := c.stream(ctx, i, key, open)
+		if err == nil {
+			c.mu.Lock()
+			c.hits[t.Name]++
+			c.mu.Unlock()
+			return nil
+		}
+		if opened {
+			return fault.Wrap(err, fmsg.With("cache tier "+t.Name))
+		}
+		if !isNotFound(err) && firstErr == nil {
+			firstErr = fault.Wrap(err, fmsg.With("cache tier "+t.Name))
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return status.Error(codes.NotFound, key+" not found in any cache tier")
+}
+
+// stream streams the artifact from tier i, reporting whether open was called. If a higher tier accepts uploads, the
+// artifact is also written to a temp file, which is then uploaded by promote. The promotion is best effort: if the
+// temp file can't be created or written, the artifact is only streamed.
+func (c *TieredClient) stream(ctx context.Context, i int, key string, open OpenFunc) (opened bool, err error) {
+	var higher []Tier
+	for _, t := range c.tiers[:i] {
+		if t.Upload {
+			higher = append(higher, t)
+		}
+	}
+
+	var promotion *promotionFile
+	if len(higher) > 0 {
+		if f, err := os.CreateTemp("", "tbc-promote-*.tmp"); err == nil {
+			promotion = &promotionFile{f: f}
+		}
+	}
+
+	var md Metadata
+	err = c.tiers[i].Client.StreamFile(ctx, key, func(info ArtifactInfo) (io.Writer, error) {
+		opened, md = true, info.Metadata
+		w, err := open(info)
+		if err != nil || promotion == nil {
+			return w, err
+		}
+		return io.MultiWriter(w, promotion), nil
+	})
+	if promotion == nil {
+		return opened, err
+	}
+
+	closeErr := promotion.f.Close()
+	if err != nil || promotion.err != nil || closeErr != nil {
+		_ = os.Remove(promotion.f.Name())
+		return opened, err
+	}
+
+	c.promote(higher, key, promotion.f.Name(), md)
+	return opened, nil
+}
+
+// promotionFile is the temp file of an artifact being promoted. Like OutboxEntry, it records write errors instead of
+// returning them, so that a full disk doesn't fail the download.
+type promotionFile struct {
+	f   *os.File
+	err error
+}
+
+func (p *promotionFile) Write(b []byte) (int, error) {
+	if p.err == nil {
+		_, p.err = p.f.Write(b)
+	}
+	return len(b), nil
+}
+
+// promote uploads the file to tiers in the background and removes it.
+func (c *TieredClient) promote(tiers []Tier, key, path string, md Metadata) {
+	c.promotions.run(func(ctx context.Context) {
+		defer func() { _ = os.Remove(path) }()
+
+		if ctx.Err() == nil {
+			// Failed promotions are retried by the next hit.
+			_ = c.uploadFile(ctx, tiers, key, path, md)
+		}
+	})
+}
+
+// Flush waits for the pending promotions to finish. If ctx is done first, they are aborted.
+func (c *TieredClient) Flush(ctx context.Context) error {
+	return c.promotions.flush(ctx)
+}
+
+// Hits returns the number of downloads served by every tier.
+func (c *TieredClient) Hits() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hits := make(map[string]int, len(c.tiers))
+	for _, t := range c.tiers {
+		hits[t.Name] = c.hits[t.Name]
+	}
+	return hits
+}
+
+// spoolFile writes the content of r to a temp file and returns its path.
+func spoolFile(r io.Reader) (string, error) {
+	f, err := os.CreateTemp("", "tbc-upload-*.tmp")
+	if err != nil {
+		return "", fault.Wrap(err, fmsg.With("error creating a temp file"))
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", fault.Wrap(err, fmsg.With("error spooling upload"))
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,189 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// unavailableClient fails every lookup, like an unreachable cache.
+type unavailableClient struct {
+	Interface
+}
+
+var errUnavailable = errors.New("cache unavailable")
+
+func (unavailableClient) StatFile(context.Context, string) (ArtifactInfo, error) {
+	return ArtifactInfo{}, errUnavailable
+}
+
+func (unavailableClient) StatFiles(context.Context, []string) (map[string]ArtifactInfo, error) {
+	return nil, errUnavailable
+}
+
+func (unavailableClient) DownloadFile(context.Context, string, io.Writer) (Metadata, error) {
+	return nil, errUnavailable
+}
+
+func (unavailableClient) StreamFile(context.Context, string, OpenFunc) error {
+	return errUnavailable
+}
+
+func (unavailableClient) UploadFile(context.Context, string, string, Metadata) error {
+	return errUnavailable
+}
+
+func TestTieredClient(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		local    = NewInMemoryClient()
+		regional = NewInMemoryClient()
+		global   = NewInMemoryClient()
+	)
+	cl, err := NewTieredClient(slog.Default(), []Tier{
+		{Name: "local", Client: local, Upload: true},
+		{Name: "regional", Client: regional, Upload: true},
+		{Name: "global", Client: global},
+	})
+	assert.NilError(t, err)
+	assert.NilError(t, cl.CheckCapabilities(ctx))
+
+	downloadAndUpload(ctx, t, cl, Metadata{"x-artifact-duration": "42"})
+	uploadReaderAndDownload(ctx, t, cl, 4096, false)
+	uploadReaderAndDownload(ctx, t, cl, 4096, true)
+
+	t.Run("uploads", func(t *testing.T) {
+		assert.NilError(t, cl.UploadReader(ctx, "uploaded", strings.NewReader("DATA"), 4, "", nil))
+
+		for tier, want := range map[*InMemoryClient]bool{local: true, regional: true, global: false} {
+			ok, err := tier.FindFile(ctx, "uploaded")
+			assert.NilError(t, err)
+			assert.Equal(t, ok, want)
+		}
+	})
+
+	t.Run("digest mismatch", func(t *testing.T) {
+		err := cl.UploadReader(ctx, "tampered", strings.NewReader("DATA"), 4, strings.Repeat("0", 64), nil)
+		assert.ErrorIs(t, err, ErrDigestMismatch)
+
+		ok, err := local.FindFile(ctx, "tampered")
+		assert.NilError(t, err)
+		assert.Equal(t, ok, false)
+	})
+
+	t.Run("promotion", func(t *testing.T) {
+		before := cl.Hits()
+		assert.NilError(t, global.UploadReader(ctx, "global", strings.NewReader("DATA"), 4, "", Metadata{"k": "v"}))
+
+		infos, err := cl.StatFiles(ctx, []string{"uploaded", "global", "missing"})
+		assert.NilError(t, err)
+		assert.DeepEqual(t, infos, map[string]ArtifactInfo{
+			"uploaded": {Size: 4}, "global": {Size: 4, Metadata: Metadata{"k": "v"}},
+		})
+
+		var buf bytes.Buffer
+		md, err := cl.DownloadFile(ctx, "global", &buf)
+		assert.NilError(t, err)
+		assert.Equal(t, buf.String(), "DATA")
+		assert.DeepEqual(t, md, Metadata{"k": "v"})
+		assert.NilError(t, cl.Flush(ctx))
+
+		for _, tier := range []*InMemoryClient{local, regional} {
+			buf.Reset()
+			md, err = tier.DownloadFile(ctx, "global", &buf)
+			assert.NilError(t, err)
+			assert.Equal(t, buf.String(), "DATA")
+			assert.DeepEqual(t, md, Metadata{"k": "v"})
+		}
+
+		buf.Reset()
+		_, err = cl.DownloadFile(ctx, "global", &buf)
+		assert.NilError(t, err)
+
+		hits := cl.Hits()
+		assert.Equal(t, hits["global"]-before["global"], 1)
+		assert.Equal(t, hits["local"]-before["local"], 1)
+	})
+
+	t.Run("promotion without a temp dir", func(t *testing.T) {
+		t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+		assert.NilError(t, global.UploadReader(ctx, "no temp", strings.NewReader("DATA"), 4, "", nil))
+
+		var buf bytes.Buffer
+		_, err := cl.DownloadFile(ctx, "no temp", &buf)
+		assert.NilError(t, err)
+		assert.Equal(t, buf.String(), "DATA")
+		assert.NilError(t, cl.Flush(ctx))
+
+		ok, err := local.FindFile(ctx, "no temp")
+		assert.NilError(t, err)
+		assert.Equal(t, ok, false)
+	})
+
+	t.Run("unavailable tier", func(t *testing.T) {
+		cl, err := NewTieredClient(slog.Default(), []Tier{
+			{Name: "regional", Client: unavailableClient{regional}, Upload: true},
+			{Name: "global", Client: global},
+		})
+		assert.NilError(t, err)
+
+		var buf bytes.Buffer
+		_, err = cl.DownloadFile(ctx, "global", &buf)
+		assert.NilError(t, err)
+		assert.Equal(t, buf.String(), "DATA")
+
+		infos, err := cl.StatFiles(ctx, []string{"global"})
+		assert.NilError(t, err)
+		assert.Equal(t, len(infos), 1)
+
+		_, err = cl.DownloadFile(ctx, "missing", &buf)
+		assert.ErrorIs(t, err, errUnavailable)
+		assert.ErrorContains(t, err, "cache tier regional")
+		assert.NilError(t, cl.Flush(ctx))
+	})
+
+	t.Run("failed uploads", func(t *testing.T) {
+		cl, err := NewTieredClient(slog.Default(), []Tier{
+			{Name: "local", Client: unavailableClient{local}, Upload: true},
+			{Name: "remote", Client: regional, Upload: true},
+		})
+		assert.NilError(t, err)
+		// stored in the remote tier
+		assert.NilError(t, cl.UploadReader(ctx, "partial", strings.NewReader("DATA"), 4, "", nil))
+		ok, err := regional.FindFile(ctx, "partial")
+		assert.NilError(t, err)
+		assert.Equal(t, ok, true)
+
+		cl, err = NewTieredClient(slog.Default(), []Tier{
+			{Name: "local", Client: local, Upload: true},
+			{Name: "remote", Client: unavailableClient{regional}, Upload: true},
+		})
+		assert.NilError(t, err)
+		err = cl.UploadReader(ctx, "remote failed", strings.NewReader("DATA"), 4, "", nil)
+		assert.ErrorIs(t, err, errUnavailable)
+		assert.ErrorContains(t, err, "cache tier remote")
+
+		cl, err = NewTieredClient(slog.Default(), []Tier{
+			{Name: "local", Client: unavailableClient{local}, Upload: true},
+			{Name: "remote", Client: regional},
+		})
+		assert.NilError(t, err)
+		path := filepath.Join(t.TempDir(), "artifact")
+		assert.NilError(t, os.WriteFile(path, []byte("DATA"), 0644))
+		err = cl.UploadFile(ctx, "all failed", path, nil)
+		assert.ErrorIs(t, err, errUnavailable)
+	})
+
+	t.Run("duplicate names", func(t *testing.T) {
+		_, err := NewTieredClient(slog.Default(), []Tier{{Name: "a", Client: local}, {Name: "a", Client: global}})
+		assert.ErrorContains(t, err, "duplicate cache tier a")
+	})
+}
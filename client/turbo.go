@@ -0,0 +1,237 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Southclaws/fault"
+	"github.com/Southclaws/fault/fctx"
+	"github.com/Southclaws/fault/fmsg"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// turboMetadataHeaders are the artifact headers kept by Turborepo remote caches. Other metadata is not stored.
+var turboMetadataHeaders = []string{
+	"x-artifact-duration",
+	"x-artifact-tag",
+}
+
+// TurboOptions configure NewTurboClient.
+type TurboOptions struct {
+	// URL of the cache, e.g. https://cache.example.com (the API is at /v8/artifacts)
+	BaseURL string
+	// Sent as a bearer token
+	Token string
+	// Team sent with artifacts whose keys are not scoped by a team (see turboClient)
+	TeamID, Slug string
+}
+
+// turboClient stores artifacts in another Turborepo remote cache (Vercel or e.g. ducktors/turborepo-remote-cache).
+//
+// Keys are [slug/][teamId/]hash (see server.makeKey), or nx/hash and gradle/key for other protocols. The last
+// segment is stored as the artifact hash and the preceding ones are sent as the team, so that the artifacts are
+// shared with turbo clients of the same team using the cache directly.
+type turboClient struct {
+	baseURL      string
+	token        string
+	teamID, slug string
+	hc           *http.Client
+}
+
+var _ Interface = (*turboClient)(nil)
+
+// NewTurboClient instantiates a client for the Turborepo remote cache. certPEMBlock and keyPEMBlock are optional,
+// see NewClientConn.
+func NewTurboClient(opts TurboOptions, certPEMBlock, keyPEMBlock []byte) (Interface, error) {
+	u, err := url.Parse(opts.BaseURL)
+	if err != nil {
+		return nil, fault.Wrap(err, fmsg.With("invalid remote cache URL"))
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fault.New("unsupported remote cache URL scheme " + u.Scheme)
+	}
+
+	tlsConfig, err := newTLSConfig(certPEMBlock, keyPEMBlock)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &turboClient{
+		baseURL: strings.TrimSuffix(u.String(), "/"),
+		token:   opts.Token,
+		teamID:  opts.TeamID,
+		slug:    opts.Slug,
+		hc:      &http.Client{Transport: transport},
+	}, nil
+}
+
+// CheckCapabilities checks that caching is enabled for the credentials.
+func (c *turboClient) CheckCapabilities(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodGet, c.baseURL+"/v8/artifacts/status", nil, 0, nil)
+	if err != nil {
+		return fault.Wrap(err, fctx.With(ctx))
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var st struct {
+		Status string `json:"status"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return fault.Wrap(err, fmsg.With("error decoding cache status"), fctx.With(ctx))
+	}
+	if st.Status != "enabled" {
+		return fault.Wrap(fault.New("remote caching is "+st.Status), fctx.With(ctx))
+	}
+	return nil
+}
+
+func (c *turboClient) UploadFile(ctx context.Context, key, filePath string, metadata Metadata) error {
+	return uploadFileViaReader(ctx, c, key, filePath, metadata)
+}
+
+// UploadReader uploads the content read from r. Content of unknown size is spooled first, as Turborepo caches
+// expect Content-Length.
+func (c *turboClient) UploadReader(ctx context.Context, key string, r io.Reader, size int64, digest string, metadata Metadata) error {
+	if size < 0 {
+		rdr, d, cleanup, err := spool(r, size)
+		defer cleanup()
+		if err != nil {
+			return fault.Wrap(err, fctx.With(ctx))
+		}
+		r, size = rdr, d.GetSizeBytes()
+	} else if digest != "" {
+		r = newDigestVerifier(r, &remoteexecution.Digest{Hash: digest, SizeBytes: size})
+	}
+
+	header := make(http.Header)
+	for _, name := range turboMetadataHeaders {
+		if v, ok := metadata[name]; ok {
+			header.Set(name, fmt.Sprint(v))
+		}
+	}
+	resp, err := c.do(ctx, http.MethodPut, c.artifactURL(key), r, size, header)
+	if err != nil {
+		return fault.Wrap(err, fmsg.With("upload failed"), fctx.With(ctx))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return fault.Wrap(resp.Body.Close(), fctx.With(ctx))
+}
+
+func (c *turboClient) FindFile(ctx context.Context, key string) (bool, error) {
+	if _, err := c.StatFile(ctx, key); err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// StatFile returns the size and metadata sent by the cache in response to HEAD. The size is UnknownSize if the
+// cache doesn't send Content-Length.
+func (c *turboClient) StatFile(ctx context.Context, key string) (ArtifactInfo, error) {
+	resp, err := c.do(ctx, http.MethodHead, c.artifactURL(key), nil, 0, nil)
+	if err != nil {
+		return ArtifactInfo{}, fault.Wrap(err, fctx.With(ctx))
+	}
+	_ = resp.Body.Close()
+
+	size := resp.ContentLength
+	if size < 0 {
+		size = UnknownSize
+	}
+	return ArtifactInfo{Size: size, Metadata: turboMetadata(resp.Header)}, nil
+}
+
+func (c *turboClient) StatFiles(ctx context.Context, keys []string) (map[string]ArtifactInfo, error) {
+	return statConcurrently(ctx, keys, c.StatFile)
+}
+
+func (c *turboClient) DownloadFile(ctx context.Context, key string, w io.Writer) (Metadata, error) {
+	return downloadFile(ctx, c, key, w)
+}
+
+func (c *turboClient) StreamFile(ctx context.Context, key string, open OpenFunc) error {
+	resp, err := c.do(ctx, http.MethodGet, c.artifactURL(key), nil, 0, nil)
+	if err != nil {
+		return fault.Wrap(err, fctx.With(ctx))
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	w, err := open(ArtifactInfo{Size: max(resp.ContentLength, UnknownSize), Metadata: turboMetadata(resp.Header)})
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		return fault.Wrap(err, fmsg.With("error reading response"), fctx.With(ctx))
+	}
+	return nil
+}
+
+// artifactURL splits key into the hash and the team, see turboClient. Like turbo, a team starting with "team_" is
+// sent as teamId and any other as slug.
+func (c *turboClient) artifactURL(key string) string {
+	var (
+		parts = strings.Split(key, "/")
+		hash  = parts[len(parts)-1]
+		query = make(url.Values)
+	)
+	switch len(parts) {
+	case 1:
+		if c.teamID != "" {
+			query.Set("teamId", c.teamID)
+		}
+		if c.slug != "" {
+			query.Set("slug", c.slug)
+		}
+	case 2:
+		if strings.HasPrefix(parts[0], "team_") {
+			query.Set("teamId", parts[0])
+		} else {
+			query.Set("slug", parts[0])
+		}
+	default:
+		query.Set("slug", strings.Join(parts[:len(parts)-2], "/"))
+		query.Set("teamId", parts[len(parts)-2])
+	}
+
+	u := c.baseURL + "/v8/artifacts/" + url.PathEscape(hash)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// do sends a request to u. Unsuccessful responses are returned as errors, 404 as a NotFound status error.
+func (c *turboClient) do(ctx context.Context, method, u string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, fault.Wrap(err, fmsg.With("error creating request"))
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return doHTTP(c.hc, req, size)
+}
+
+func turboMetadata(h http.Header) (md Metadata) {
+	for _, name := range turboMetadataHeaders {
+		if v := h.Get(name); v != "" {
+			if md == nil {
+				md = make(Metadata)
+			}
+			md[name] = v
+		}
+	}
+	return
+}
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// fakeTurboCache is a stand-in for a Turborepo remote cache accepting the token "secret". Artifacts are stored by
+// the request URI without the host.
+type fakeTurboCache struct {
+	mu        sync.Mutex
+	artifacts map[string]fakeS3Object
+	status    string
+}
+
+func newFakeTurboCache(t *testing.T) (*fakeTurboCache, *httptest.Server) {
+	f := &fakeTurboCache{artifacts: make(map[string]fakeS3Object), status: "enabled"}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeTurboCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/v8/artifacts/status" {
+		_, _ = io.WriteString(w, `{"status":"`+f.status+`"}`)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		if r.ContentLength < 0 {
+			w.WriteHeader(http.StatusLengthRequired)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		f.artifacts[r.URL.RequestURI()] = fakeS3Object{data: data, header: r.Header.Clone()}
+		w.WriteHeader(http.StatusAccepted)
+
+	case http.MethodGet, http.MethodHead:
+		a, ok := f.artifacts[r.URL.RequestURI()]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for _, name := range turboMetadataHeaders {
+			if v := a.header.Get(name); v != "" {
+				w.Header().Set(name, v)
+			}
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(a.data)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(a.data)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeTurboCache) setStatus(status string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.status = status
+}
+
+func (f *fakeTurboCache) has(uri string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.artifacts[uri]
+	return ok
+}
+
+func TestTurboClient(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		fake, sv = newFakeTurboCache(t)
+	)
+	cl, err := NewTurboClient(TurboOptions{BaseURL: sv.URL + "/", Token: "secret", TeamID: "team_default"}, nil, nil)
+	assert.NilError(t, err)
+	assert.NilError(t, cl.CheckCapabilities(ctx))
+
+	downloadAndUpload(ctx, t, cl, Metadata{"x-artifact-duration": "42", "x-artifact-tag": "tag"})
+	downloadAndUpload(ctx, t, cl, nil)
+
+	t.Run("unknown size", func(t *testing.T) {
+		content := make([]byte, 3000)
+		_, err := rand.Read(content)
+		assert.NilError(t, err)
+
+		assert.NilError(t, cl.UploadReader(ctx, "unknown", bytes.NewReader(content), UnknownSize, "", nil))
+
+		var buf bytes.Buffer
+		_, err = cl.DownloadFile(ctx, "unknown", &buf)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, buf.Bytes(), content)
+	})
+
+	t.Run("teams", func(t *testing.T) {
+		for key, uri := range map[string]string{
+			"hash":                 "/v8/artifacts/hash?teamId=team_default",
+			"ignore/hash":          "/v8/artifacts/hash?slug=ignore",
+			"team_abc/hash":        "/v8/artifacts/hash?teamId=team_abc",
+			"my-slug/team_x/hash":  "/v8/artifacts/hash?slug=my-slug&teamId=team_x",
+			"nx/8375049":           "/v8/artifacts/8375049?slug=nx",
+			"gradle/0a1b2c":        "/v8/artifacts/0a1b2c?slug=gradle",
+			"my-slug/team_x/a b+c": "/v8/artifacts/a%20b+c?slug=my-slug&teamId=team_x",
+		} {
+			assert.NilError(t, cl.UploadReader(ctx, key, strings.NewReader("DATA"), 4, "", nil))
+			assert.Assert(t, fake.has(uri), "%s is not stored at %s", key, uri)
+		}
+	})
+
+	t.Run("metadata not kept by the cache", func(t *testing.T) {
+		err := cl.UploadReader(ctx, "md", strings.NewReader("DATA"), 4, "", Metadata{"x-artifact-tag": "tag", "k": "v"})
+		assert.NilError(t, err)
+
+		info, err := cl.StatFile(ctx, "md")
+		assert.NilError(t, err)
+		assert.DeepEqual(t, info.Metadata, Metadata{"x-artifact-tag": "tag"})
+	})
+
+	t.Run("digest mismatch", func(t *testing.T) {
+		err := cl.UploadReader(ctx, "tampered", strings.NewReader("DATA"), 4, strings.Repeat("0", 64), nil)
+		assert.ErrorIs(t, err, ErrDigestMismatch)
+	})
+
+	t.Run("caching disabled", func(t *testing.T) {
+		fake.setStatus("disabled")
+		defer fake.setStatus("enabled")
+
+		assert.ErrorContains(t, cl.CheckCapabilities(ctx), "remote caching is disabled")
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		cl, err := NewTurboClient(TurboOptions{BaseURL: sv.URL, Token: "other"}, nil, nil)
+		assert.NilError(t, err)
+		assert.ErrorContains(t, cl.CheckCapabilities(ctx), "401 Unauthorized")
+	})
+}
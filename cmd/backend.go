@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/Southclaws/fault"
+	"github.com/Southclaws/fault/fmsg"
+	"github.com/be9/tbc/client"
+	"google.golang.org/grpc"
+)
+
+// backendFactory creates a client for a remote cache URL, see backends.
+type backendFactory func(url string, certPEM, keyPEM []byte) (client.Interface, error)
+
+// backends maps RemoteCacheHost URL schemes to the remote caches they select. A plain host:port is a gRPC
+// remote cache.
+var backends = map[string]backendFactory{
+	"http":  client.NewHTTPClient,
+	"https": client.NewHTTPClient,
+	"file":  newFileClient,
+	"s3":    newS3Client,
+
+	"turbo+http":  newTurboClient,
+	"turbo+https": newTurboClient,
+}
+
+// newFileClient creates a client for file:///path/to/dir?max_size=10GB (max_size is optional).
+func newFileClient(rawURL string, _, _ []byte) (client.Interface, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fault.Wrap(err, fmsg.With("invalid remote cache URL"))
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fault.New("file:// URLs must not have a host, use file:///path/to/dir")
+	}
+	maxSize, err := ParseSize(u.Query().Get("max_size"))
+	if err != nil {
+		return nil, fault.Wrap(err, fmsg.With("invalid max_size"))
+	}
+	return client.NewFileClient(u.Path, maxSize)
+}
+
+// remoteTierName is the name of the RemoteCacheHost tier, see Options.Tiers.
+const remoteTierName = "remote"
+
+// newRemoteClient creates the client for RemoteCacheHost, mirrored to MirrorHost if set, in a client.TieredClient
+// behind Options.Tiers if there are any.
+func (cmd *Cmd) newRemoteClient() (client.Interface, error) {
+	remote, cc, err := cmd.newBackend(cmd.opts.RemoteCacheHost)
+	if err != nil {
+		return nil, err
+	}
+	cmd.cc = cc
+	if cmd.opts.BazelHTTP {
+		if cc == nil {
+			return nil, fault.New("--bazel-http requires a gRPC remote cache")
+		}
+		cmd.blobs = client.NewBlobStore(cc)
+	}
+	if cmd.opts.MirrorHost != "" {
+		if remote, err = cmd.newMirrorClient(remote); err != nil {
+			return nil, err
+		}
+	}
+	if len(cmd.opts.Tiers) == 0 {
+		return remote, nil
+	}
+
+	var (
+		tiers  []client.Tier
+		upload = func(name string) bool {
+			return len(cmd.opts.UploadTiers) == 0 || slices.Contains(cmd.opts.UploadTiers, name)
+		}
+	)
+	for _, spec := range cmd.opts.Tiers {
+		name, host, ok := strings.Cut(spec, "=")
+		if !ok || name == "" || name == remoteTierName {
+			return nil, fault.New(fmt.Sprintf("invalid cache tier %q, expected NAME=HOST", spec))
+		}
+		cl, cc, err := cmd.newBackend(host)
+		if err != nil {
+			return nil, fault.Wrap(err, fmsg.With("cache tier "+name))
+		}
+		if cc != nil {
+			cmd.tierConns = append(cmd.tierConns, cc)
+		}
+		tiers = append(tiers, client.Tier{Name: name, Client: cl, Upload: upload(name)})
+	}
+	tiers = append(tiers, client.Tier{Name: remoteTierName, Client: remote, Upload: upload(remoteTierName)})
+
+	for _, name := range cmd.opts.UploadTiers {
+		if !slices.ContainsFunc(tiers, func(t client.Tier) bool { return t.Name == name }) {
+			return nil, fault.New("unknown upload tier " + name)
+		}
+	}
+	if cmd.tiered, err = client.NewTieredClient(cmd.logger, tiers); err != nil {
+		return nil, err
+	}
+	return cmd.tiered, nil
+}
+
+// newMirrorClient wraps primary in a client.MirrorClient writing to MirrorHost as well.
+func (cmd *Cmd) newMirrorClient(primary client.Interface) (client.Interface, error) {
+	secondary, cc, err := cmd.newBackend(cmd.opts.MirrorHost)
+	if err != nil {
+		return nil, fault.Wrap(err, fmsg.With("mirror cache"))
+	}
+	cmd.mirrorCC = cc
+
+	var report io.Writer
+	if cmd.opts.MirrorReportPath != "" {
+		f, err := os.OpenFile(cmd.opts.MirrorReportPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fault.Wrap(err, fmsg.With("error opening mirror report"))
+		}
+		cmd.mirrorReport = f
+		report = f
+	}
+	cmd.mirror = client.NewMirrorClient(primary, secondary, report)
+	return cmd.mirror, nil
+}
+
+// newBackend creates the client for host, see RemoteCacheHost. For a gRPC remote cache, the connection is returned
+// as well.
+func (cmd *Cmd) newBackend(host string) (client.Interface, *grpc.ClientConn, error) {
+	var certPEM, keyPEM []byte
+
+	if cmd.opts.RemoteCacheTLS != nil {
+		certPEM = cmd.opts.RemoteCacheTLS.CertPEM
+		keyPEM = cmd.opts.RemoteCacheTLS.KeyPEM
+	}
+
+	if scheme, _, ok := strings.Cut(host, "://"); ok {
+		newClient, ok := backends[scheme]
+		if !ok {
+			return nil, nil, fault.New("unsupported remote cache scheme " + scheme)
+		}
+		if cmd.opts.Codec != "" && strings.HasPrefix(scheme, "turbo+") {
+			// the codec is recorded in metadata, which Turborepo caches don't keep
+			return nil, nil, fault.New("--compress is not supported with a Turborepo remote cache")
+		}
+		cl, err := newClient(host, certPEM, keyPEM)
+		return cl, nil, err
+	}
+
+	cc, err := client.NewClientConn(host, certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client.NewClient(cc), cc, nil
+}
+
+// newS3Client creates a client for s3://bucket/prefix?region=eu-west-1&endpoint=http://localhost:9000 (region and
+// endpoint are optional). Credentials are taken from the standard AWS environment variables.
+func newS3Client(rawURL string, _, _ []byte) (client.Interface, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fault.Wrap(err, fmsg.With("invalid remote cache URL"))
+	}
+
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	q := u.Query()
+	return client.NewS3Client(client.S3Options{
+		Bucket:          u.Host,
+		Prefix:          prefix,
+		Region:          cmp.Or(q.Get("region"), os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")),
+		Endpoint:        cmp.Or(q.Get("endpoint"), os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL")),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	})
+}
+
+// newTurboClient creates a client for turbo+https://cache.example.com/prefix?teamId=team_abc&slug=my-team (teamId
+// and slug are optional). The token is taken from TBC_TURBO_TOKEN.
+func newTurboClient(rawURL string, certPEM, keyPEM []byte) (client.Interface, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fault.Wrap(err, fmsg.With("invalid remote cache URL"))
+	}
+
+	q := u.Query()
+	u.Scheme = strings.TrimPrefix(u.Scheme, "turbo+")
+	u.RawQuery = ""
+	return client.NewTurboClient(client.TurboOptions{
+		BaseURL: u.String(),
+		Token:   os.Getenv("TBC_TURBO_TOKEN"),
+		TeamID:  q.Get("teamId"),
+		Slug:    q.Get("slug"),
+	}, certPEM, keyPEM)
+}
@@ -2,12 +2,16 @@ package cmd
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -16,6 +20,7 @@ import (
 	"github.com/be9/tbc/client"
 	"github.com/be9/tbc/server"
 	"github.com/hashicorp/go-retryablehttp"
+	"google.golang.org/grpc"
 )
 
 // Options carries CLI options, see Main.
@@ -25,7 +30,8 @@ type Options struct {
 	// Command's arguments.
 	Args []string
 
-	// The remote cache host
+	// The remote cache host: host:port of a gRPC remote cache, or a URL whose scheme selects another backend
+	// (see backends)
 	RemoteCacheHost string
 	// Timeout used for remote cache operations
 	RemoteCacheTimeout time.Duration
@@ -33,13 +39,63 @@ type Options struct {
 	// Certs for TLS (nil means insecure)
 	RemoteCacheTLS *TLSCerts
 
-	// The address to bind to
+	// Faster caches looked up before RemoteCacheHost as NAME=HOST, see client.TieredClient. The remote cache is
+	// the last tier, named "remote".
+	Tiers []string
+	// Names of the tiers uploads go to (all of them if empty)
+	UploadTiers []string
+
+	// If set, artifacts are also written to this cache, and reads are compared with it, see client.MirrorClient
+	MirrorHost string
+	// If set, the discrepancies found by comparing reads with MirrorHost are appended to this file as JSON lines.
+	MirrorReportPath string
+
+	// If set, artifacts are recompressed with this codec before they are stored, see client.NewCodecClient
+	Codec string
+
+	// If set, artifacts are also kept in a local LRU cache in this directory
+	DiskCacheDir string
+	// Maximum size of the local cache in bytes (0 means no limit)
+	DiskCacheMaxSize int64
+
+	// The address to bind to: host:port or unix:///path/to/socket
 	BindAddr string
-	// If true, the command will set TURBO_API, TURBO_TOKEN, and TURBO_TEAM variables (unless they are already set)
+	// If true, the command will set TURBO_API, TURBO_TOKEN, and TURBO_TEAM variables (unless they are already set).
+	// For nx, NX_SELF_HOSTED_REMOTE_CACHE_SERVER and NX_SELF_HOSTED_REMOTE_CACHE_ACCESS_TOKEN are set instead.
 	AutoEnv bool
 	// Additional environment overrides.
 	Env []string
 
+	// Restricts operations forwarded to the remote cache
+	Mode server.Mode
+
+	// Artifacts outside these limits are accepted but not stored, see server.Options
+	MaxUploadSize int64
+	MinUploadSize int64
+	MinDuration   time.Duration
+
+	// If set, the proxy verifies artifact signatures with this key (TURBO_REMOTE_CACHE_SIGNATURE_KEY).
+	SignatureKey string
+
+	// If true, uploads are performed in the background, see server.Options.AsyncUploads
+	AsyncUploads bool
+	// Number of background upload workers
+	UploadWorkers int
+	// How long to wait for in-flight requests after the command exits
+	ShutdownTimeout time.Duration
+	// How long to wait for background uploads after the command exits
+	FlushTimeout time.Duration
+	// If set, failed uploads are kept in this directory and retried by the next run, see server.Options.Outbox
+	OutboxDir string
+
+	// If set, cache events reported by turbo are appended to this file as JSON lines.
+	EventsLogPath string
+
+	// Path prefix of the Gradle HTTP build cache, see server.Options.GradlePrefix
+	GradlePrefix string
+	// If true, the Bazel HTTP cache protocol is served as well, see server.Options.BlobStore
+	BazelHTTP bool
+
 	// If true, just run the command.
 	Disabled bool
 	// If remote cache connection or proxy server start fails, just run the command.
@@ -51,17 +107,35 @@ type TLSCerts struct {
 }
 
 type Cmd struct {
-	opts   Options
-	logger *slog.Logger
-	cl     client.Interface
-	srv    *server.Server
+	opts      Options
+	logger    *slog.Logger
+	cc        *grpc.ClientConn
+	tierConns []*grpc.ClientConn
+	cl        client.Interface
+	blobs     client.BlobStore
+	srv       *server.Server
+	httpSrv   *http.Server
+	eventsLog *os.File
+
+	// tiered and mirror are parts of cl reporting statistics, if configured (see newRemoteClient)
+	tiered       *client.TieredClient
+	mirror       *client.MirrorClient
+	mirrorCC     *grpc.ClientConn
+	mirrorReport *os.File
+
+	// shim forwards loopback TCP connections to the Unix domain socket, see startShim
+	shim *http.Server
+	// apiURL is the base URL of the server for turbo
+	apiURL string
+	// token is required by the server, see proxyToken
+	token string
 }
 
 // Main is the CLI entry.
 func Main(
 	logger *slog.Logger,
 	opts Options,
-) (exitCode int, serverStats server.Stats, errorsIgnored bool, err error) {
+) (exitCode int, summary Summary, errorsIgnored bool, err error) {
 	var (
 		cmd = &Cmd{opts: opts, logger: logger}
 
@@ -76,6 +150,8 @@ func Main(
 			return nil
 		}
 	)
+	defer cmd.close()
+
 	if !cmd.opts.Disabled {
 		clientServerErr := startClientAndServer()
 		if clientServerErr != nil {
@@ -85,7 +161,7 @@ func Main(
 
 				errorsIgnored = true
 			} else {
-				return 1, serverStats, false, clientServerErr
+				return 1, summary, false, clientServerErr
 			}
 		}
 	}
@@ -99,42 +175,56 @@ func Main(
 
 	if serverActuallyRuns {
 		if cmd.opts.AutoEnv {
-			c.Env = cmd.turboEnvironment()
+			if cmd.isNx() {
+				c.Env = cmd.nxEnvironment()
+			} else {
+				c.Env = cmd.turboEnvironment()
+			}
 		}
 		if len(cmd.opts.Env) > 0 {
 			c.Env = append(c.Env, cmd.opts.Env...)
 		}
 	}
 	if err = c.Start(); err != nil {
-		return 1, server.Stats{}, false, fault.Wrap(err, fmsg.With("error starting command"))
+		return 1, Summary{}, false, fault.Wrap(err, fmsg.With("error starting command"))
 	}
 	if err = c.Wait(); err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
 			exitCode = exitError.ExitCode()
 		} else {
-			return 1, server.Stats{}, false, fault.Wrap(err, fmsg.With("error running command"))
+			return 1, Summary{}, false, fault.Wrap(err, fmsg.With("error running command"))
 		}
 	}
 	if serverActuallyRuns {
-		serverStats = cmd.srv.GetStatistics()
+		cmd.shutdown()
+		summary.Stats = cmd.srv.GetStatistics()
+		if cmd.tiered != nil {
+			summary.TierHits = cmd.tiered.Hits()
+		}
+		if cmd.mirror != nil {
+			summary.Mirror = cmd.mirror.Counts()
+		}
 	}
 	return
 }
 
 // instantiateClient creates the client connection and runs CheckCapabilities
 func (cmd *Cmd) instantiateClient() error {
-	var certPEM, keyPEM []byte
-
-	if cmd.opts.RemoteCacheTLS != nil {
-		certPEM = cmd.opts.RemoteCacheTLS.CertPEM
-		keyPEM = cmd.opts.RemoteCacheTLS.KeyPEM
-	}
-
-	cc, err := client.NewClientConn(cmd.opts.RemoteCacheHost, certPEM, keyPEM)
+	cl, err := cmd.newRemoteClient()
 	if err != nil {
 		return err
 	}
-	cl := client.NewClient(cc)
+
+	if cmd.opts.Codec != "" {
+		if cl, err = client.NewCodecClient(cl, cmd.opts.Codec); err != nil {
+			return err
+		}
+	}
+	if cmd.opts.DiskCacheDir != "" {
+		if cl, err = client.NewDiskCache(cl, cmd.opts.DiskCacheDir, cmd.opts.DiskCacheMaxSize); err != nil {
+			return err
+		}
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), cmd.opts.RemoteCacheTimeout)
 	defer cancel()
@@ -151,18 +241,46 @@ func (cmd *Cmd) instantiateClient() error {
 // startServer creates the server, starts HTTP listener in a goroutine, and uses HTTP GET
 // with retries to check that the server is up.
 func (cmd *Cmd) startServer() error {
-	srv := server.NewServer(cmd.logger, cmd.cl, server.Options{}) // the token is not used
+	token, err := cmd.proxyToken()
+	if err != nil {
+		return err
+	}
+	srvOpts := server.Options{
+		Token:         token,
+		Mode:          cmd.opts.Mode,
+		SignatureKey:  cmd.opts.SignatureKey,
+		AsyncUploads:  cmd.opts.AsyncUploads,
+		UploadWorkers: cmd.opts.UploadWorkers,
+		MaxUploadSize: cmd.opts.MaxUploadSize,
+		MinUploadSize: cmd.opts.MinUploadSize,
+		MinDuration:   cmd.opts.MinDuration,
+		GradlePrefix:  cmd.opts.GradlePrefix,
+	}
+	if cmd.opts.EventsLogPath != "" {
+		f, err := os.OpenFile(cmd.opts.EventsLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fault.Wrap(err, fmsg.With("error opening events log"))
+		}
+		cmd.eventsLog = f
+		srvOpts.EventsLog = f
+	}
+	srv, err := cmd.newServer(srvOpts)
+	if err != nil {
+		return err
+	}
 
-	addr := cmd.opts.BindAddr
-	httpSrv := &http.Server{
-		Addr:    addr,
-		Handler: srv.CreateHandler(),
+	// bind synchronously, so that errors are reported right away
+	ln, err := listen(cmd.opts.BindAddr)
+	if err != nil {
+		return err
 	}
+	addr := boundAddr(cmd.opts.BindAddr, ln)
+	cmd.httpSrv = &http.Server{Handler: srv.CreateHandler()}
 
 	go func() {
 		cmd.logger.Debug("starting HTTP server", slog.String("addr", addr))
 
-		if err := httpSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if err := cmd.httpSrv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			// we can't directly signal this error from the goroutine, but in case this happens,
 			// the accessibility check will fail.
 			cmd.logger.Error(err.Error())
@@ -171,38 +289,211 @@ func (cmd *Cmd) startServer() error {
 
 	hc := retryablehttp.NewClient()
 	hc.Logger = nil
-	if resp, err := hc.Get(serverCheckURL(addr)); err != nil {
+	hc.HTTPClient.Transport = transportFor(addr)
+	req, err := retryablehttp.NewRequest("GET", serverCheckURL(addr), nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if resp, err := hc.Do(req); err != nil {
 		return err
 	} else {
 		_ = resp.Body.Close()
 		cmd.logger.Debug("HTTP server is accessible", slog.Int("status", resp.StatusCode))
 	}
 
+	cmd.apiURL = serverBaseURL(addr)
+	if _, ok := unixSocketPath(addr); ok && cmd.opts.AutoEnv {
+		if cmd.apiURL, err = cmd.startShim(); err != nil {
+			return err
+		}
+	}
+
 	cmd.srv = srv
+	srv.ReplayOutbox()
 	return nil
 }
 
+// proxyToken returns the bearer token the server requires: TURBO_TOKEN (or its nx equivalent) if it's set, so
+// that turbo configured by the user keeps working, or a random token for this run, which is passed to the command
+// by AutoEnv. Without either, any local process could write artifacts to the remote cache through the proxy, so
+// that is an error.
+func (cmd *Cmd) proxyToken() (string, error) {
+	tokenVar := "TURBO_TOKEN"
+	if cmd.isNx() {
+		tokenVar = nxTokenVar
+	}
+	if token, ok := os.LookupEnv(tokenVar); ok {
+		if token == "" {
+			return "", fault.New(tokenVar + " is empty, but the proxy requires a token")
+		}
+		cmd.token = token
+		return cmd.token, nil
+	}
+	if !cmd.opts.AutoEnv {
+		return "", fault.New(tokenVar + " must be set when --auto-env is disabled, as the proxy requires a token")
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fault.Wrap(err, fmsg.With("error generating token"))
+	}
+	cmd.token = hex.EncodeToString(b)
+	return cmd.token, nil
+}
+
+// close releases the listeners (removing the Unix domain socket, if any), the remote cache connections, the
+// events log, and the mirror report.
+func (cmd *Cmd) close() {
+	if cmd.shim != nil {
+		_ = cmd.shim.Close()
+	}
+	if cmd.httpSrv != nil {
+		_ = cmd.httpSrv.Close()
+	}
+	if cmd.cc != nil {
+		_ = cmd.cc.Close()
+	}
+	for _, cc := range cmd.tierConns {
+		_ = cc.Close()
+	}
+	if cmd.mirrorCC != nil {
+		_ = cmd.mirrorCC.Close()
+	}
+	if cmd.eventsLog != nil {
+		_ = cmd.eventsLog.Close()
+	}
+	if cmd.mirrorReport != nil {
+		_ = cmd.mirrorReport.Close()
+	}
+}
+
+// shutdown stops the server gracefully: it waits for in-flight requests, then for background uploads.
+func (cmd *Cmd) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), cmd.opts.ShutdownTimeout)
+	defer cancel()
+
+	if err := cmd.srv.Shutdown(ctx, cmd.httpSrv); err != nil {
+		cmd.logger.Error("requests did not finish in time", slog.String("err", err.Error()))
+	}
+	cmd.flush()
+}
+
+// newServer creates the server with the outbox, if configured.
+func (cmd *Cmd) newServer(srvOpts server.Options) (*server.Server, error) {
+	if cmd.opts.OutboxDir != "" {
+		outbox, err := client.NewOutbox(cmd.opts.OutboxDir)
+		if err != nil {
+			return nil, err
+		}
+		srvOpts.Outbox = outbox
+	}
+	srvOpts.BlobStore = cmd.blobs
+	return server.NewServer(cmd.logger, cmd.cl, srvOpts), nil
+}
+
+// flush waits for background uploads, promotions between cache tiers, and mirror comparisons to finish.
+func (cmd *Cmd) flush() {
+	ctx, cancel := context.WithTimeout(context.Background(), cmd.opts.FlushTimeout)
+	defer cancel()
+
+	if err := cmd.srv.Flush(ctx); err != nil {
+		cmd.logger.Error("background uploads did not finish in time", slog.String("err", err.Error()))
+	}
+	if cmd.tiered != nil {
+		if err := cmd.tiered.Flush(ctx); err != nil {
+			cmd.logger.Error("cache tier promotions did not finish in time", slog.String("err", err.Error()))
+		}
+	}
+	if cmd.mirror != nil {
+		if err := cmd.mirror.Flush(ctx); err != nil {
+			cmd.logger.Error("mirror comparisons did not finish in time", slog.String("err", err.Error()))
+		}
+	}
+}
+
+// Flush uploads the artifacts left in the outbox by previous runs.
+func Flush(logger *slog.Logger, opts Options) (server.Stats, error) {
+	if opts.OutboxDir == "" {
+		return server.Stats{}, errors.New("outbox directory is not set")
+	}
+
+	cmd := &Cmd{opts: opts, logger: logger}
+	defer cmd.close()
+
+	if err := cmd.instantiateClient(); err != nil {
+		return server.Stats{}, fault.Wrap(err, fmsg.With("failed to create remote cache client"))
+	}
+	srv, err := cmd.newServer(server.Options{Mode: opts.Mode})
+	if err != nil {
+		return server.Stats{}, err
+	}
+	cmd.srv = srv
+
+	srv.ReplayOutbox()
+	cmd.flush()
+	return srv.GetStatistics(), nil
+}
+
 func serverCheckURL(addr string) string {
 	return serverBaseURL(addr) + "/v8/artifacts/status"
 }
 
+// serverBaseURL returns the URL of the server at addr. For Unix domain sockets, the host is a placeholder, see
+// transportFor.
 func serverBaseURL(addr string) string {
+	if _, ok := unixSocketPath(addr); ok {
+		return "http://localhost"
+	}
 	if strings.HasPrefix(addr, ":") {
 		addr = "localhost" + addr
 	}
 	return fmt.Sprintf("http://%s", addr)
 }
 
+const (
+	nxServerVar = "NX_SELF_HOSTED_REMOTE_CACHE_SERVER"
+	nxTokenVar  = "NX_SELF_HOSTED_REMOTE_CACHE_ACCESS_TOKEN"
+)
+
+// packageRunners run the tool named by their first argument, e.g. npx nx build.
+var packageRunners = []string{"npx", "pnpx", "bunx", "pnpm", "yarn"}
+
+// isNx reports whether the command runs nx, directly or through a package runner.
+func (cmd *Cmd) isNx() bool {
+	name := filepath.Base(cmd.opts.Command)
+	if slices.Contains(packageRunners, name) && len(cmd.opts.Args) > 0 {
+		name = cmd.opts.Args[0]
+	}
+	return name == "nx"
+}
+
+func (cmd *Cmd) nxEnvironment() []string {
+	var (
+		env = os.Environ()
+		ok  bool
+	)
+	if _, ok = os.LookupEnv(nxServerVar); !ok {
+		env = append(env, fmt.Sprintf("%s=%s", nxServerVar, cmd.apiURL))
+	}
+	if _, ok = os.LookupEnv(nxTokenVar); !ok {
+		env = append(env, fmt.Sprintf("%s=%s", nxTokenVar, cmd.token))
+	}
+	return env
+}
+
 func (cmd *Cmd) turboEnvironment() []string {
 	var (
 		env = os.Environ()
 		ok  bool
 	)
 	if _, ok = os.LookupEnv("TURBO_API"); !ok {
-		env = append(env, fmt.Sprintf("TURBO_API=%s", serverBaseURL(cmd.opts.BindAddr)))
+		env = append(env, fmt.Sprintf("TURBO_API=%s", cmd.apiURL))
 	}
 	if _, ok = os.LookupEnv("TURBO_TOKEN"); !ok {
-		env = append(env, "TURBO_TOKEN=ignore")
+		env = append(env, fmt.Sprintf("TURBO_TOKEN=%s", cmd.token))
 	}
 	if _, ok = os.LookupEnv("TURBO_TEAM"); !ok {
 		env = append(env, "TURBO_TEAM=ignore")
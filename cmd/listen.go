@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Southclaws/fault"
+	"github.com/Southclaws/fault/fmsg"
+)
+
+// unixScheme prefixes BindAddr values that name a Unix domain socket, e.g. unix:///tmp/tbc.sock.
+const unixScheme = "unix://"
+
+// unixSocketPath returns the socket path if addr names a Unix domain socket.
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixScheme), true
+}
+
+// listen binds to addr, which is either host:port or unix:///path/to/socket. A stale socket left by a process
+// that didn't exit cleanly is replaced. The socket is only accessible to the current user, and it is removed
+// when the listener is closed.
+func listen(addr string) (net.Listener, error) {
+	path, ok := unixSocketPath(addr)
+	if !ok {
+		ln, err := net.Listen("tcp", addr)
+		return ln, fault.Wrap(err, fmsg.With("error binding to "+addr))
+	}
+
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			_ = conn.Close()
+			return nil, fault.New(path + " is in use")
+		}
+		_ = os.Remove(path)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fault.Wrap(err, fmsg.With("error binding to "+path))
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		_ = ln.Close()
+		return nil, fault.Wrap(err, fmsg.With("error restricting socket permissions"))
+	}
+	return ln, nil
+}
+
+// boundAddr returns the address the server can be reached at. It differs from addr if addr has port 0, which
+// makes the system pick a free port.
+func boundAddr(addr string, ln net.Listener) string {
+	if _, ok := unixSocketPath(addr); ok {
+		return addr
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ln.Addr().String()
+	}
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		return ln.Addr().String()
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// transportFor returns an HTTP transport that connects to the server at addr. For Unix domain sockets, the host
+// part of request URLs is ignored.
+func transportFor(addr string) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if path, ok := unixSocketPath(addr); ok {
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+	}
+	return t
+}
+
+// startShim starts a loopback TCP proxy to the server listening on a Unix domain socket, because turbo only
+// supports http(s) URLs. Returns the base URL of the proxy.
+func (cmd *Cmd) startShim() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fault.Wrap(err, fmsg.With("error starting loopback shim"))
+	}
+
+	target := &url.URL{Scheme: "http", Host: "localhost"}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transportFor(cmd.opts.BindAddr)
+
+	cmd.shim = &http.Server{Handler: proxy}
+	go func() {
+		if err := cmd.shim.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			cmd.logger.Error(err.Error())
+		}
+	}()
+
+	baseURL := "http://" + ln.Addr().String()
+	cmd.logger.Debug("started loopback shim", slog.String("url", baseURL))
+	return baseURL, nil
+}
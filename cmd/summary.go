@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"log/slog"
+	"sort"
+
+	"github.com/be9/tbc/server"
+)
+
+// Summary holds the statistics of a run: those of the server, and those kept by the parts of the remote client
+// the server doesn't know about.
+type Summary struct {
+	server.Stats
+	// Downloads served by every tier of a tiered remote cache, see client.TieredClient.Hits
+	TierHits map[string]int
+	// Reads compared with the mirror cache and the discrepancies found by kind, see client.MirrorClient.Counts
+	Mirror map[string]int
+}
+
+// SlogArgs converts the summary to an array that can be passed to slog logging functions, see server.Stats.SlogArgs.
+func (s Summary) SlogArgs() []any {
+	result := s.Stats.SlogArgs()
+	if len(s.TierHits) > 0 {
+		result = append(result, slog.Any("tier_hits", countersGroup(s.TierHits)))
+	}
+	if len(s.Mirror) > 0 {
+		result = append(result, slog.Any("mirror", countersGroup(s.Mirror)))
+	}
+	return result
+}
+
+// countersGroup converts counters to a slog group sorted by name.
+func countersGroup(counters map[string]int) slog.Value {
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	attrs := make([]slog.Attr, 0, len(names))
+	for _, name := range names {
+		attrs = append(attrs, slog.Int(name, counters[name]))
+	}
+	return slog.GroupValue(attrs...)
+}
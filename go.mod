@@ -8,6 +8,7 @@ require (
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/mux v1.8.1
 	github.com/hashicorp/go-retryablehttp v0.7.7
+	github.com/klauspost/compress v1.17.9
 	github.com/urfave/cli/v2 v2.27.2
 	google.golang.org/api v0.154.0
 	google.golang.org/grpc v1.59.0
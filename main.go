@@ -2,19 +2,34 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"log/slog"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/be9/tbc/cmd"
+	"github.com/be9/tbc/server"
 	"github.com/urfave/cli/v2"
 )
 
 const (
-	VerboseFlag = "verbose"
-	SummaryFlag = "summary"
+	VerboseFlag          = "verbose"
+	SummaryFlag          = "summary"
+	VerifySignaturesFlag = "verify-signatures"
+	DiskCacheSizeFlag    = "disk-cache-size"
+	ModeFlag             = "mode"
+	MaxUploadSizeFlag    = "max-upload-size"
+	MinUploadSizeFlag    = "min-upload-size"
+	GradlePrefixFlag     = "gradle-prefix"
+	TierFlag             = "tier"
+	UploadTiersFlag      = "upload-tiers"
 
-	defaultCacheTimeout = 30 * time.Second
+	defaultCacheTimeout    = 30 * time.Second
+	defaultShutdownTimeout = 10 * time.Second
+	defaultFlushTimeout    = time.Minute
+	defaultUploadWorkers   = 4
+	defaultDiskCacheSizeMB = 10 * 1024
 )
 
 func main() {
@@ -31,15 +46,57 @@ func main() {
 			&cli.StringFlag{
 				Name:        "host",
 				EnvVars:     []string{"TBC_HOST"},
-				Usage:       "Remote cache server `HOST`",
+				Usage:       "Remote cache server `HOST`: host:port for gRPC, http(s)://host/prefix for an HTTP cache, s3://bucket/prefix, turbo+https://host for a Turborepo cache, or file:///path/to/dir",
 				Required:    true,
 				Aliases:     []string{"H"},
 				Destination: &opts.RemoteCacheHost,
 			},
+			&cli.StringSliceFlag{
+				Name:    TierFlag,
+				EnvVars: []string{"TBC_TIERS"},
+				Usage:   "Faster cache looked up before --host, as `NAME=HOST` (HOST as in --host); can be repeated, tiers are looked up in order",
+			},
+			&cli.StringSliceFlag{
+				Name:    UploadTiersFlag,
+				EnvVars: []string{"TBC_UPLOAD_TIERS"},
+				Usage:   "Upload only to these `TIERS` (the --host tier is called \"remote\"); all tiers by default",
+			},
+			&cli.StringFlag{
+				Name:        "mirror",
+				EnvVars:     []string{"TBC_MIRROR"},
+				Usage:       "Also write artifacts to the cache at `HOST` (as in --host) and compare reads with it",
+				Destination: &opts.MirrorHost,
+			},
+			&cli.StringFlag{
+				Name:        "mirror-report",
+				EnvVars:     []string{"TBC_MIRROR_REPORT"},
+				Usage:       "Append the artifacts the --mirror cache misses or returns differently to `FILE` (JSON lines)",
+				TakesFile:   true,
+				Destination: &opts.MirrorReportPath,
+			},
+			&cli.StringFlag{
+				Name:        "compress",
+				EnvVars:     []string{"TBC_COMPRESS"},
+				Usage:       "Recompress artifacts with `CODEC` (zstd or gzip) before storing them",
+				Destination: &opts.Codec,
+			},
+			&cli.StringFlag{
+				Name:        "disk-cache",
+				EnvVars:     []string{"TBC_DISK_CACHE"},
+				Usage:       "Keep artifacts in a local LRU cache in `DIR` (can be shared by several tbc processes)",
+				TakesFile:   true,
+				Destination: &opts.DiskCacheDir,
+			},
+			&cli.Int64Flag{
+				Name:    DiskCacheSizeFlag,
+				EnvVars: []string{"TBC_DISK_CACHE_SIZE"},
+				Usage:   "Local cache size limit in `MB` (0 means no limit)",
+				Value:   defaultDiskCacheSizeMB,
+			},
 			&cli.StringFlag{
 				Name:        "addr",
 				EnvVars:     []string{"TBC_ADDR"},
-				Usage:       "Address to bind to",
+				Usage:       "Address to bind to: host:port or unix:///path/to/socket",
 				Value:       "127.0.0.1:8080",
 				Destination: &opts.BindAddr,
 			},
@@ -71,6 +128,85 @@ func main() {
 				Value:       true,
 				Destination: &opts.AutoEnv,
 			},
+			&cli.StringFlag{
+				Name:    ModeFlag,
+				EnvVars: []string{"TBC_MODE"},
+				Usage:   "Cache access `MODE`: read-write, read-only (uploads are discarded), or write-only (lookups miss)",
+				Value:   string(server.ModeReadWrite),
+			},
+			&cli.StringFlag{
+				Name:    MaxUploadSizeFlag,
+				EnvVars: []string{"TBC_MAX_UPLOAD_SIZE"},
+				Usage:   "Don't store artifacts larger than `SIZE` (e.g. 500MB, 2GB)",
+			},
+			&cli.StringFlag{
+				Name:    MinUploadSizeFlag,
+				EnvVars: []string{"TBC_MIN_UPLOAD_SIZE"},
+				Usage:   "Don't store artifacts smaller than `SIZE` (e.g. 512, 1KB)",
+			},
+			&cli.DurationFlag{
+				Name:        "min-duration",
+				EnvVars:     []string{"TBC_MIN_DURATION"},
+				Usage:       "Don't store artifacts of tasks that took less than this",
+				Destination: &opts.MinDuration,
+			},
+			&cli.BoolFlag{
+				Name:    VerifySignaturesFlag,
+				EnvVars: []string{"TBC_VERIFY_SIGNATURES"},
+				Usage:   "Verify artifact signatures with TURBO_REMOTE_CACHE_SIGNATURE_KEY",
+			},
+			&cli.BoolFlag{
+				Name:        "async-uploads",
+				EnvVars:     []string{"TBC_ASYNC_UPLOADS"},
+				Usage:       "Acknowledge uploads right away and upload in the background",
+				Destination: &opts.AsyncUploads,
+			},
+			&cli.IntFlag{
+				Name:        "upload-workers",
+				EnvVars:     []string{"TBC_UPLOAD_WORKERS"},
+				Usage:       "Number of background upload workers",
+				Value:       defaultUploadWorkers,
+				Destination: &opts.UploadWorkers,
+			},
+			&cli.DurationFlag{
+				Name:        "shutdown-timeout",
+				EnvVars:     []string{"TBC_SHUTDOWN_TIMEOUT"},
+				Usage:       "How long to wait for in-flight requests after the command exits",
+				Value:       defaultShutdownTimeout,
+				Destination: &opts.ShutdownTimeout,
+			},
+			&cli.DurationFlag{
+				Name:        "flush-timeout",
+				EnvVars:     []string{"TBC_FLUSH_TIMEOUT"},
+				Usage:       "How long to wait for background uploads after the command exits",
+				Value:       defaultFlushTimeout,
+				Destination: &opts.FlushTimeout,
+			},
+			&cli.StringFlag{
+				Name:        "outbox",
+				EnvVars:     []string{"TBC_OUTBOX"},
+				Usage:       "Keep failed uploads in `DIR` and retry them on the next run or with 'tbc flush'",
+				TakesFile:   true,
+				Destination: &opts.OutboxDir,
+			},
+			&cli.StringFlag{
+				Name:    GradlePrefixFlag,
+				EnvVars: []string{"TBC_GRADLE_PREFIX"},
+				Usage:   "Serve the Gradle HTTP build cache under `PATH`, e.g. /cache (disabled by default)",
+			},
+			&cli.BoolFlag{
+				Name:        "bazel-http",
+				EnvVars:     []string{"TBC_BAZEL_HTTP"},
+				Usage:       "Serve the Bazel HTTP cache protocol (/ac and /cas) backed by the remote cache; CAS blobs are only found after this process served their action result or upload",
+				Destination: &opts.BazelHTTP,
+			},
+			&cli.StringFlag{
+				Name:        "events-log",
+				EnvVars:     []string{"TBC_EVENTS_LOG"},
+				Usage:       "Append cache events reported by turbo to `FILE` (JSON lines)",
+				TakesFile:   true,
+				Destination: &opts.EventsLogPath,
+			},
 			&cli.BoolFlag{
 				Name:        "ignore-failures",
 				EnvVars:     []string{"TBC_IGNORE_FAILURES"},
@@ -104,6 +240,9 @@ func main() {
 			if (certFile != "") != (keyFile != "") {
 				return cli.Exit(errors.New("--tls-cert and --tls-key must be provided together"), 1)
 			}
+			if opts.MirrorReportPath != "" && opts.MirrorHost == "" {
+				return cli.Exit(errors.New("--mirror-report requires --mirror"), 1)
+			}
 			if certFile != "" {
 				certPEMBlock, err := os.ReadFile(certFile)
 				if err != nil {
@@ -116,6 +255,35 @@ func main() {
 				opts.RemoteCacheTLS = &cmd.TLSCerts{CertPEM: certPEMBlock, KeyPEM: keyPEMBlock}
 			}
 
+			mode, err := server.ParseMode(c.String(ModeFlag))
+			if err != nil {
+				return cli.Exit(err, 1)
+			}
+			opts.Mode = mode
+
+			if c.Bool(VerifySignaturesFlag) {
+				opts.SignatureKey = os.Getenv("TURBO_REMOTE_CACHE_SIGNATURE_KEY")
+				if opts.SignatureKey == "" {
+					return cli.Exit(errors.New("--verify-signatures requires TURBO_REMOTE_CACHE_SIGNATURE_KEY to be set"), 1)
+				}
+			}
+
+			opts.DiskCacheMaxSize = c.Int64(DiskCacheSizeFlag) * 1024 * 1024
+
+			if opts.MaxUploadSize, err = cmd.ParseSize(c.String(MaxUploadSizeFlag)); err != nil {
+				return cli.Exit(fmt.Errorf("--%s: %w", MaxUploadSizeFlag, err), 1)
+			}
+			if opts.MinUploadSize, err = cmd.ParseSize(c.String(MinUploadSizeFlag)); err != nil {
+				return cli.Exit(fmt.Errorf("--%s: %w", MinUploadSizeFlag, err), 1)
+			}
+
+			opts.Tiers = c.StringSlice(TierFlag)
+			opts.UploadTiers = c.StringSlice(UploadTiersFlag)
+
+			if prefix := strings.Trim(c.String(GradlePrefixFlag), "/"); prefix != "" {
+				opts.GradlePrefix = "/" + prefix
+			}
+
 			opts.Command = c.Args().First()
 			opts.Args = c.Args().Tail()
 
@@ -132,6 +300,25 @@ func main() {
 			os.Exit(exitCode)
 			return nil
 		},
+		Commands: []*cli.Command{
+			{
+				Name:  "flush",
+				Usage: "Upload artifacts left in the outbox (--outbox) by previous runs",
+				Action: func(c *cli.Context) error {
+					stats, err := cmd.Flush(logger, opts)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					if c.Bool(SummaryFlag) {
+						logger.Info("server stats", stats.SlogArgs()...)
+					}
+					if stats.OutboxReplayFailedCount > 0 {
+						return cli.Exit("some artifacts were not uploaded", 1)
+					}
+					return nil
+				},
+			},
+		},
 		HideHelpCommand: true,
 		ArgsUsage:       "command <command arguments>",
 		Description: `Spin up a Turborepo-compatible remote cache server that forwards requests to a Bazel-compatible remote cache server
@@ -139,8 +326,10 @@ and execute the provided command.
 
 Examples:
 
-# Check the server with curl (by default, the server binds to 127.0.0.1:8080)
-tbc --host bazel-cache-host:port curl http://localhost:8080/v8/artifacts/status
+# Check the server with curl (by default, the server binds to 127.0.0.1:8080 and requires TURBO_TOKEN)
+env TURBO_TOKEN=secret \
+    tbc --host bazel-cache-host:port \
+    sh -c 'curl -H "Authorization: Bearer $TURBO_TOKEN" http://localhost:8080/v8/artifacts/status'
 
 # Run 'turbo build' with auto-set variables; if cache doesn't work, run the command ignoring the cache:
 env TURBO_REMOTE_CACHE_SIGNATURE_KEY=super_secret \
@@ -150,7 +339,7 @@ env TURBO_REMOTE_CACHE_SIGNATURE_KEY=super_secret \
 # Run 'turbo build' with manually set vars:
 env TURBO_REMOTE_CACHE_SIGNATURE_KEY=super_secret \
     TURBO_API=http://localhost:8080 \
-    TURBO_TOKEN=any \		# this is not actually used, but required to be set by turbo
+    TURBO_TOKEN=any \		# the proxy only accepts requests with this token
     TURBO_TEAM=any \
     tbc --host bazel-cache-host:port \
     --summary \
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/be9/tbc/client"
+	"github.com/gorilla/mux"
+	"google.golang.org/protobuf/proto"
+)
+
+// The handlers below implement the Bazel HTTP cache protocol (/ac/{hash} and /cas/{hash}, as served by
+// bazel-remote) on top of Options.BlobStore, see
+// https://bazel.build/remote/caching#http-caching
+
+// maxActionResultSize limits the size of uploaded action results, which are small protobuf messages.
+const maxActionResultSize = 16 * 1024 * 1024
+
+// maxBlobIndexEntries limits the number of blobs remembered by blobIndex (roughly 200 bytes each).
+const maxBlobIndexEntries = 256 * 1024
+
+// blobIndex remembers the sizes of CAS blobs. The HTTP protocol addresses blobs by hash only, while REAPI needs the
+// size as well. Clients download the action result before its outputs, so the sizes are learned from the action
+// results and trees served to the client, and from uploads. The least recently used blobs are forgotten once there
+// are more than maxBlobIndexEntries.
+type blobIndex struct {
+	mu    sync.Mutex
+	blobs map[string]*list.Element
+	// lru holds blobRefs, the most recently used first
+	lru list.List
+	// limit overrides maxBlobIndexEntries in tests
+	limit int
+}
+
+type blobRef struct {
+	hash string
+	size int64
+	// tree is set for the Tree messages of output directories, whose files are indexed when the tree is served.
+	tree bool
+}
+
+func (x *blobIndex) add(d *remoteexecution.Digest, tree bool) {
+	if d.GetHash() == "" {
+		return
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	ref := blobRef{hash: d.GetHash(), size: d.GetSizeBytes(), tree: tree}
+	if e, ok := x.blobs[ref.hash]; ok {
+		e.Value = ref
+		x.lru.MoveToFront(e)
+		return
+	}
+
+	if x.blobs == nil {
+		x.blobs = make(map[string]*list.Element)
+	}
+	x.blobs[ref.hash] = x.lru.PushFront(ref)
+
+	limit := x.limit
+	if limit <= 0 {
+		limit = maxBlobIndexEntries
+	}
+	for x.lru.Len() > limit {
+		oldest := x.lru.Back()
+		x.lru.Remove(oldest)
+		delete(x.blobs, oldest.Value.(blobRef).hash)
+	}
+}
+
+func (x *blobIndex) get(hash string) (blobRef, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	e, ok := x.blobs[hash]
+	if !ok {
+		return blobRef{}, false
+	}
+	x.lru.MoveToFront(e)
+	return e.Value.(blobRef), true
+}
+
+func (x *blobIndex) addActionResult(ar *remoteexecution.ActionResult) {
+	for _, f := range ar.GetOutputFiles() {
+		x.add(f.GetDigest(), false)
+	}
+	for _, d := range ar.GetOutputDirectories() {
+		x.add(d.GetTreeDigest(), true)
+	}
+	x.add(ar.GetStdoutDigest(), false)
+	x.add(ar.GetStderrDigest(), false)
+}
+
+func (x *blobIndex) addTree(t *remoteexecution.Tree) {
+	for _, dir := range append([]*remoteexecution.Directory{t.GetRoot()}, t.GetChildren()...) {
+		for _, f := range dir.GetFiles() {
+			x.add(f.GetDigest(), false)
+		}
+	}
+}
+
+func (s *Server) acDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	if !s.opts.Mode.canRead() {
+		s.record(Stats{SkippedLookupCount: 1})
+		http.Error(w, msgKeyNotFound, http.StatusNotFound)
+		return
+	}
+
+	ar, err := s.blobs.GetActionResult(makeContext(r.Context(), r), hash)
+	if err != nil {
+		if isNotFound(err) {
+			s.reportBlobNotFound(w, r)
+			return
+		}
+		http.Error(w, msgDownloadFailed, http.StatusInternalServerError)
+		s.logError(err)
+		return
+	}
+
+	data, err := proto.Marshal(ar)
+	if err != nil {
+		http.Error(w, msgDownloadFailed, http.StatusInternalServerError)
+		s.logError(err)
+		return
+	}
+	s.blobIndex.addActionResult(ar)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if r.Method == http.MethodHead {
+		s.record(Stats{ExistsYesCount: 1})
+		return
+	}
+	_, _ = w.Write(data)
+	s.record(Stats{DownloadCount: 1, DownloadedBytes: int64(len(data))})
+}
+
+func (s *Server) acUploadHandler(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	if s.discardBlob(w, r) {
+		return
+	}
+
+	// read a byte more than allowed to tell a large action result from one of the maximum size
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxActionResultSize+1))
+	if err != nil {
+		http.Error(w, msgUploadFailed, http.StatusInternalServerError)
+		s.logError(err)
+		return
+	}
+	if len(data) > maxActionResultSize {
+		http.Error(w, "action result too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	ar := &remoteexecution.ActionResult{}
+	if err = proto.Unmarshal(data, ar); err != nil {
+		http.Error(w, "bad action result", http.StatusBadRequest)
+		return
+	}
+
+	if err = s.blobs.UpdateActionResult(makeContext(r.Context(), r), hash, ar); err != nil {
+		http.Error(w, msgUploadFailed, http.StatusInternalServerError)
+		s.logError(err)
+		return
+	}
+	s.blobIndex.addActionResult(ar)
+	s.record(Stats{UploadCount: 1, UploadedBytes: int64(len(data))})
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) casDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	if !s.opts.Mode.canRead() {
+		s.record(Stats{SkippedLookupCount: 1})
+		http.Error(w, msgKeyNotFound, http.StatusNotFound)
+		return
+	}
+
+	reportError := func(err error) {
+		http.Error(w, msgDownloadFailed, http.StatusInternalServerError)
+		s.logError(err)
+	}
+
+	// Without the size, the blob can't be looked up, so it is reported as missing and the client will rebuild it
+	ref, ok := s.blobIndex.get(hash)
+	if !ok {
+		s.reportBlobNotFound(w, r)
+		return
+	}
+
+	ctx := makeContext(r.Context(), r)
+	if r.Method == http.MethodHead {
+		found, err := s.blobs.FindBlob(ctx, hash, ref.size)
+		if err != nil {
+			reportError(err)
+			return
+		}
+		if !found {
+			s.reportBlobNotFound(w, r)
+			return
+		}
+		s.record(Stats{ExistsYesCount: 1})
+		w.Header().Set("Content-Length", strconv.FormatInt(ref.size, 10))
+		return
+	}
+
+	var (
+		body           = &countingWriter{w: w}
+		dst  io.Writer = body
+		tree bytes.Buffer
+	)
+	if ref.tree {
+		// Trees are small, so they are buffered to learn the sizes of the files in the directory
+		dst = &tree
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(ref.size, 10))
+
+	err := s.blobs.ReadBlob(ctx, hash, ref.size, dst)
+	if err == nil && ref.tree {
+		t := &remoteexecution.Tree{}
+		if proto.Unmarshal(tree.Bytes(), t) == nil {
+			s.blobIndex.addTree(t)
+		}
+		_, err = body.Write(tree.Bytes())
+	}
+	if err != nil {
+		if body.n > 0 {
+			// The response is already on its way, so the only way to signal the error is to abort the connection
+			s.logError(err)
+			panic(http.ErrAbortHandler)
+		}
+
+		w.Header().Del("Content-Length")
+		if isNotFound(err) {
+			s.reportBlobNotFound(w, r)
+			return
+		}
+		reportError(err)
+		return
+	}
+
+	s.record(Stats{DownloadCount: 1, DownloadedBytes: body.n})
+}
+
+func (s *Server) casUploadHandler(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	if s.discardBlob(w, r) {
+		return
+	}
+
+	body := &countingReader{r: r.Body}
+	size := r.ContentLength
+	if size < 0 {
+		size = client.UnknownSize
+	}
+
+	if err := s.blobs.WriteBlob(makeContext(r.Context(), r), hash, size, body); err != nil {
+		if errors.Is(err, client.ErrDigestMismatch) {
+			http.Error(w, "content does not match the hash", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, msgUploadFailed, http.StatusInternalServerError)
+		s.logError(err)
+		return
+	}
+
+	s.blobIndex.add(&remoteexecution.Digest{Hash: hash, SizeBytes: body.n}, false)
+	s.record(Stats{UploadCount: 1, UploadedBytes: body.n})
+	w.WriteHeader(http.StatusOK)
+}
+
+// reportBlobNotFound counts the miss as a failed lookup or download, depending on the method.
+func (s *Server) reportBlobNotFound(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead {
+		s.record(Stats{ExistsNoCount: 1})
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.record(Stats{DownloadNotFoundCount: 1})
+	http.Error(w, msgKeyNotFound, http.StatusNotFound)
+}
+
+// discardBlob accepts and drops the upload if the mode doesn't allow writes. Size and duration limits don't apply
+// here: an action result referencing a skipped blob would be useless.
+func (s *Server) discardBlob(w http.ResponseWriter, r *http.Request) bool {
+	if s.opts.Mode.canWrite() {
+		return false
+	}
+	_, _ = io.Copy(io.Discard, r.Body)
+	s.record(Stats{SkippedUploadCount: 1})
+	w.WriteHeader(http.StatusOK)
+	return true
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// cacheEvent is a cache event reported by turbo to POST /v8/artifacts/events.
+type cacheEvent struct {
+	SessionID string `json:"sessionId,omitempty"`
+	// LOCAL or REMOTE
+	Source string `json:"source"`
+	// HIT or MISS
+	Event string `json:"event"`
+	Hash  string `json:"hash"`
+	// For hits, the duration of the original task in milliseconds, that is, the time saved.
+	Duration int64 `json:"duration"`
+}
+
+// loggedEvent is a line of the events log.
+type loggedEvent struct {
+	Time time.Time `json:"time"`
+	cacheEvent
+}
+
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	var events []cacheEvent
+	if r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&events); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, ev := range events {
+		s.record(eventStats(ev))
+	}
+	s.logEvents(events)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// eventStats returns the statistics of ev. Sessions are not told apart: the time saved by all of them adds up, and
+// only the events log keeps the session of every event.
+func eventStats(ev cacheEvent) (delta Stats) {
+	switch {
+	case ev.Source == "LOCAL" && ev.Event == "HIT":
+		delta.LocalHitCount = 1
+	case ev.Source == "LOCAL" && ev.Event == "MISS":
+		delta.LocalMissCount = 1
+	case ev.Source == "REMOTE" && ev.Event == "HIT":
+		delta.RemoteHitCount = 1
+	case ev.Source == "REMOTE" && ev.Event == "MISS":
+		delta.RemoteMissCount = 1
+	}
+	if ev.Event == "HIT" {
+		delta.TimeSavedMs = ev.Duration
+	}
+	return
+}
+
+// logEvents appends events to Options.EventsLog, one JSON object per line.
+func (s *Server) logEvents(events []cacheEvent) {
+	if s.opts.EventsLog == nil || len(events) == 0 {
+		return
+	}
+
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+
+	enc := json.NewEncoder(s.opts.EventsLog)
+	now := time.Now().UTC()
+	for _, ev := range events {
+		if err := enc.Encode(loggedEvent{Time: now, cacheEvent: ev}); err != nil {
+			s.logger.Error("[tbc] error writing events log", slog.String("err", err.Error()))
+			return
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// gradleKeyPrefix keeps Gradle build cache entries apart from turbo artifacts, see nxKeyPrefix.
+const gradleKeyPrefix = "gradle:"
+
+// The handlers below implement the Gradle HTTP build cache protocol, see
+// https://docs.gradle.org/current/userguide/build_cache.html#sec:build_cache_configure_remote
+
+func (s *Server) gradleUploadHandler(w http.ResponseWriter, r *http.Request) {
+	key := getGradleKey(w, r)
+	if key == "" {
+		return
+	}
+
+	if s.discardUpload(w, r, gradleUploads) {
+		return
+	}
+	s.storeUpload(w, r, key, r.Body, nil, gradleUploads)
+}
+
+// gradleUploads reports oversized entries with 413, which Gradle does not treat as an error.
+var gradleUploads = uploadResponses{
+	accepted: func(w http.ResponseWriter) { w.WriteHeader(http.StatusOK) },
+	tooLarge: func(w http.ResponseWriter) {
+		http.Error(w, "entry is too large", http.StatusRequestEntityTooLarge)
+	},
+}
+
+func (s *Server) gradleDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	key := getGradleKey(w, r)
+	if key == "" {
+		return
+	}
+	s.serveArtifact(w, r, key, false)
+}
+
+func getGradleKey(w http.ResponseWriter, r *http.Request) string {
+	key := mux.Vars(r)["key"]
+
+	// Sanity check
+	if key == "" {
+		http.Error(w, "bad key", http.StatusInternalServerError)
+		return ""
+	}
+
+	return gradleKeyPrefix + key
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	errTooLarge = errors.New("artifact exceeds the maximum upload size")
+	errTooSmall = errors.New("artifact is below the minimum upload size")
+	errTooFast  = errors.New("task duration is below the minimum")
+)
+
+// checkLimits checks the artifact against Options.MaxUploadSize, MinUploadSize, and MinDuration.
+// size is negative if the request has no Content-Length; such bodies are checked by limitReader.
+func (s *Server) checkLimits(size int64, h http.Header) error {
+	if size >= 0 {
+		if s.opts.MaxUploadSize > 0 && size > s.opts.MaxUploadSize {
+			return errTooLarge
+		}
+		if size < s.opts.MinUploadSize {
+			return errTooSmall
+		}
+	}
+	if s.opts.MinDuration > 0 {
+		// artifacts without a valid duration are stored
+		if ms, err := strconv.ParseInt(h.Get("X-Artifact-Duration"), 10, 64); err == nil &&
+			time.Duration(ms)*time.Millisecond < s.opts.MinDuration {
+			return errTooFast
+		}
+	}
+	return nil
+}
+
+// hasSizeLimits reports whether uploads of unknown size have to go through limitReader.
+func (s *Server) hasSizeLimits() bool {
+	return s.opts.MaxUploadSize > 0 || s.opts.MinUploadSize > 0
+}
+
+// limitError returns the statistics for an upload skipped due to err, or false if err is not a limit error.
+func limitError(err error) (Stats, bool) {
+	switch {
+	case errors.Is(err, errTooLarge):
+		return Stats{SkippedTooLargeCount: 1}, true
+	case errors.Is(err, errTooSmall):
+		return Stats{SkippedTooSmallCount: 1}, true
+	case errors.Is(err, errTooFast):
+		return Stats{SkippedTooFastCount: 1}, true
+	}
+	return Stats{}, false
+}
+
+// skipUpload responds to the upload without storing it, see discardUpload.
+func (s *Server) skipUpload(w http.ResponseWriter, r *http.Request, delta Stats, resp uploadResponses) {
+	_, _ = io.Copy(io.Discard, r.Body)
+	s.record(delta)
+
+	if delta.SkippedTooLargeCount > 0 && resp.tooLarge != nil {
+		resp.tooLarge(w)
+		return
+	}
+	resp.accepted(w)
+}
+
+// limitReader enforces size limits on a body of unknown size. It returns errTooLarge as soon as more than max
+// bytes are read (if max > 0), and errTooSmall instead of io.EOF if fewer than min bytes were read.
+type limitReader struct {
+	r        io.Reader
+	min, max int64
+	n        int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+
+	if l.max > 0 && l.n > l.max {
+		return n, errTooLarge
+	}
+	if err == io.EOF && l.n < l.min {
+		return n, errTooSmall
+	}
+	return n, err
+}
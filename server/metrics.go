@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/be9/tbc/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Operations used as the "operation" label of the HTTP request metrics.
+const (
+	opQuery    = "query"
+	opUpload   = "upload"
+	opExists   = "exists"
+	opDownload = "download"
+)
+
+var operations = []string{opQuery, opUpload, opExists, opDownload}
+
+// latencyBuckets are the upper bounds (in seconds) of the request duration histogram buckets.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64 // one per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.count++
+	h.sum += v
+	if i := sort.SearchFloat64s(latencyBuckets, v); i < len(latencyBuckets) {
+		h.counts[i]++
+	}
+}
+
+// remoteCall identifies a client.Interface method and the gRPC status code it returned.
+type remoteCall struct {
+	method string
+	code   codes.Code
+}
+
+// metrics holds the metrics that are not part of Stats. All of them are safe for concurrent use.
+type metrics struct {
+	inFlight map[string]*atomic.Int64
+	latency  map[string]*histogram
+
+	mu          sync.Mutex
+	remoteCalls map[remoteCall]int64
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		inFlight:    make(map[string]*atomic.Int64),
+		latency:     make(map[string]*histogram),
+		remoteCalls: make(map[remoteCall]int64),
+	}
+	for _, op := range operations {
+		m.inFlight[op] = new(atomic.Int64)
+		m.latency[op] = newHistogram()
+	}
+	return m
+}
+
+// instrument tracks in-flight requests and request duration of handler h serving op.
+func (m *metrics) instrument(op string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.inFlight[op].Add(1)
+		start := time.Now()
+
+		defer func() {
+			m.inFlight[op].Add(-1)
+			m.latency[op].observe(time.Since(start).Seconds())
+		}()
+
+		h(w, r)
+	}
+}
+
+// inFlightTotal returns the number of requests being served.
+func (m *metrics) inFlightTotal() int {
+	var total int64
+	for _, n := range m.inFlight {
+		total += n.Load()
+	}
+	return int(total)
+}
+
+func (m *metrics) observeRemoteCall(method string, err error) {
+	code := codes.OK
+	if err != nil {
+		code = codes.Unknown
+		if s, ok := status.FromError(err); ok {
+			code = s.Code()
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remoteCalls[remoteCall{method: method, code: code}]++
+}
+
+// write renders stats and m in Prometheus text exposition format.
+func (m *metrics) write(w io.Writer, stats Stats) {
+	types := reflect.TypeOf(stats)
+	values := reflect.ValueOf(stats)
+	for i := 0; i < types.NumField(); i++ {
+		f := types.Field(i)
+		name := fmt.Sprintf("tbc_%s_total", f.Tag.Get("slog"))
+		writeHeader(w, name, f.Tag.Get("help"), "counter")
+		_, _ = fmt.Fprintf(w, "%s %d\n", name, values.Field(i).Int())
+	}
+
+	writeHeader(w, "tbc_requests_in_flight", "Requests currently being served.", "gauge")
+	for _, op := range operations {
+		_, _ = fmt.Fprintf(w, "tbc_requests_in_flight{operation=%q} %d\n", op, m.inFlight[op].Load())
+	}
+
+	writeHeader(w, "tbc_request_duration_seconds", "Duration of served requests.", "histogram")
+	for _, op := range operations {
+		h := m.latency[op]
+		h.mu.Lock()
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			_, _ = fmt.Fprintf(w, "tbc_request_duration_seconds_bucket{operation=%q,le=%q} %d\n",
+				op, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		_, _ = fmt.Fprintf(w, "tbc_request_duration_seconds_bucket{operation=%q,le=\"+Inf\"} %d\n", op, h.count)
+		_, _ = fmt.Fprintf(w, "tbc_request_duration_seconds_sum{operation=%q} %g\n", op, h.sum)
+		_, _ = fmt.Fprintf(w, "tbc_request_duration_seconds_count{operation=%q} %d\n", op, h.count)
+		h.mu.Unlock()
+	}
+
+	writeHeader(w, "tbc_remote_requests_total", "Remote cache calls by method and gRPC status code.", "counter")
+	m.mu.Lock()
+	calls := make([]remoteCall, 0, len(m.remoteCalls))
+	for c := range m.remoteCalls {
+		calls = append(calls, c)
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		if calls[i].method != calls[j].method {
+			return calls[i].method < calls[j].method
+		}
+		return calls[i].code < calls[j].code
+	})
+	for _, c := range calls {
+		_, _ = fmt.Fprintf(w, "tbc_remote_requests_total{method=%q,code=%q} %d\n", c.method, c.code, m.remoteCalls[c])
+	}
+	m.mu.Unlock()
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// instrumentedClient records the status of every remote cache call in metrics.
+type instrumentedClient struct {
+	client.Interface
+	m *metrics
+}
+
+func (c *instrumentedClient) UploadFile(ctx context.Context, key, filePath string, metadata client.Metadata) error {
+	err := c.Interface.UploadFile(ctx, key, filePath, metadata)
+	c.m.observeRemoteCall("upload", err)
+	return err
+}
+
+func (c *instrumentedClient) UploadReader(
+	ctx context.Context, key string, r io.Reader, size int64, digest string, metadata client.Metadata,
+) error {
+	err := c.Interface.UploadReader(ctx, key, r, size, digest, metadata)
+	c.m.observeRemoteCall("upload", err)
+	return err
+}
+
+func (c *instrumentedClient) FindFile(ctx context.Context, key string) (bool, error) {
+	ok, err := c.Interface.FindFile(ctx, key)
+	c.m.observeRemoteCall("find", err)
+	return ok, err
+}
+
+func (c *instrumentedClient) StatFile(ctx context.Context, key string) (client.ArtifactInfo, error) {
+	info, err := c.Interface.StatFile(ctx, key)
+	c.m.observeRemoteCall("stat", err)
+	return info, err
+}
+
+func (c *instrumentedClient) StatFiles(ctx context.Context, keys []string) (map[string]client.ArtifactInfo, error) {
+	infos, err := c.Interface.StatFiles(ctx, keys)
+	c.m.observeRemoteCall("stat_batch", err)
+	return infos, err
+}
+
+func (c *instrumentedClient) DownloadFile(ctx context.Context, key string, w io.Writer) (client.Metadata, error) {
+	md, err := c.Interface.DownloadFile(ctx, key, w)
+	c.m.observeRemoteCall("download", err)
+	return md, err
+}
+
+func (c *instrumentedClient) StreamFile(ctx context.Context, key string, open client.OpenFunc) error {
+	err := c.Interface.StreamFile(ctx, key, open)
+	c.m.observeRemoteCall("download", err)
+	return err
+}
+
+// instrumentedBlobStore records the status of every remote cache call in metrics.
+type instrumentedBlobStore struct {
+	client.BlobStore
+	m *metrics
+}
+
+func (b *instrumentedBlobStore) GetActionResult(ctx context.Context, hash string) (*remoteexecution.ActionResult, error) {
+	ar, err := b.BlobStore.GetActionResult(ctx, hash)
+	b.m.observeRemoteCall("get_action_result", err)
+	return ar, err
+}
+
+func (b *instrumentedBlobStore) UpdateActionResult(ctx context.Context, hash string, ar *remoteexecution.ActionResult) error {
+	err := b.BlobStore.UpdateActionResult(ctx, hash, ar)
+	b.m.observeRemoteCall("update_action_result", err)
+	return err
+}
+
+func (b *instrumentedBlobStore) FindBlob(ctx context.Context, hash string, size int64) (bool, error) {
+	ok, err := b.BlobStore.FindBlob(ctx, hash, size)
+	b.m.observeRemoteCall("find_blob", err)
+	return ok, err
+}
+
+func (b *instrumentedBlobStore) ReadBlob(ctx context.Context, hash string, size int64, w io.Writer) error {
+	err := b.BlobStore.ReadBlob(ctx, hash, size, w)
+	b.m.observeRemoteCall("read_blob", err)
+	return err
+}
+
+func (b *instrumentedBlobStore) WriteBlob(ctx context.Context, hash string, size int64, r io.Reader) error {
+	err := b.BlobStore.WriteBlob(ctx, hash, size, r)
+	b.m.observeRemoteCall("write_blob", err)
+	return err
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"fmt"
+)
+
+// Mode restricts the operations the server forwards to the remote cache.
+type Mode string
+
+const (
+	// ModeReadWrite forwards all operations. This is the default.
+	ModeReadWrite Mode = "read-write"
+	// ModeReadOnly accepts and discards uploads, e.g. for untrusted PR builds.
+	ModeReadOnly Mode = "read-only"
+	// ModeWriteOnly reports every artifact as missing, e.g. for cache warm-up jobs.
+	ModeWriteOnly Mode = "write-only"
+)
+
+// ParseMode validates a mode name.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case ModeReadWrite, ModeReadOnly, ModeWriteOnly:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown mode %q, must be one of %s, %s, %s", s, ModeReadWrite, ModeReadOnly, ModeWriteOnly)
+	}
+}
+
+func (m Mode) canRead() bool {
+	return m != ModeWriteOnly
+}
+
+func (m Mode) canWrite() bool {
+	return m != ModeReadOnly
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// nxKeyPrefix keeps Nx artifacts apart from turbo ones, whose keys can't contain ":" (see makeKey).
+const nxKeyPrefix = "nx:"
+
+// The handlers below implement the Nx self-hosted remote cache API, see
+// https://nx.dev/recipes/running-tasks/self-hosted-caching#build-your-own-caching-server
+
+func (s *Server) nxUploadHandler(w http.ResponseWriter, r *http.Request) {
+	key := getNxKey(w, r)
+	if key == "" {
+		return
+	}
+
+	if s.discardUpload(w, r, nxUploads) {
+		return
+	}
+
+	// Nx artifacts are immutable, so the API forbids overwriting them
+	if s.opts.Mode.canRead() {
+		ok, err := s.cl.FindFile(makeContext(r.Context(), r), key)
+		if err != nil {
+			http.Error(w, msgUploadFailed, http.StatusInternalServerError)
+			s.logError(err)
+			return
+		}
+		if ok {
+			_, _ = io.Copy(io.Discard, r.Body)
+			http.Error(w, "Cannot override an existing record", http.StatusConflict)
+			return
+		}
+	}
+
+	s.storeUpload(w, r, key, r.Body, nil, nxUploads)
+}
+
+var nxUploads = uploadResponses{
+	accepted: func(w http.ResponseWriter) { w.WriteHeader(http.StatusOK) },
+}
+
+func (s *Server) nxDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	key := getNxKey(w, r)
+	if key == "" {
+		return
+	}
+	s.serveArtifact(w, r, key, false)
+}
+
+func getNxKey(w http.ResponseWriter, r *http.Request) string {
+	hash := mux.Vars(r)["hash"]
+
+	// Sanity check
+	if hash == "" {
+		http.Error(w, "bad hash", http.StatusInternalServerError)
+		return ""
+	}
+
+	return nxKeyPrefix + hash
+}
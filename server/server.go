@@ -2,13 +2,17 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
-	"os"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Southclaws/fault/fctx"
@@ -18,9 +22,43 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// Response bodies of the errors shared by the handlers of all protocols.
+const (
+	msgKeyNotFound    = "key not found"
+	msgUploadFailed   = "unable to upload"
+	msgDownloadFailed = "unable to download"
+)
+
 // Options for creating a server.
 type Options struct {
 	Token string
+	// Restricts operations forwarded to the remote cache. Empty means ModeReadWrite.
+	Mode Mode
+	// If set, x-artifact-tag of uploaded and downloaded artifacts is verified with this key
+	// (TURBO_REMOTE_CACHE_SIGNATURE_KEY).
+	SignatureKey string
+	// If set, cache events reported by turbo are appended here as JSON lines.
+	EventsLog io.Writer
+	// If set, the Gradle HTTP build cache is served under this path prefix, e.g. /cache.
+	GradlePrefix string
+	// If set, the Bazel HTTP cache protocol (/ac and /cas) is served from this store.
+	BlobStore client.BlobStore
+
+	// Artifacts larger than this are accepted but not stored (0 means no limit).
+	MaxUploadSize int64
+	// Artifacts smaller than this are accepted but not stored.
+	MinUploadSize int64
+	// Artifacts of tasks that took less than this (x-artifact-duration) are accepted but not stored.
+	MinDuration time.Duration
+
+	// If true, uploads are acknowledged right away and performed in the background. See Server.Flush.
+	AsyncUploads bool
+	// Number of background upload workers (default 4).
+	UploadWorkers int
+	// Maximum number of uploads waiting for a worker (default 64). When the queue is full, uploads block.
+	UploadQueueSize int
+	// If set, uploads that fail or do not finish before Flush are kept here, to be retried with ReplayOutbox.
+	Outbox *client.Outbox
 }
 
 type Server struct {
@@ -28,48 +66,135 @@ type Server struct {
 	cl     client.Interface
 	logger *slog.Logger
 
-	stats Stats
+	statsMu sync.Mutex
+	stats   Stats
+	metrics *metrics
+
+	eventsMu sync.Mutex
+
+	uploader *uploader
+
+	// blobs serves the Bazel HTTP cache protocol, see Options.BlobStore
+	blobs     client.BlobStore
+	blobIndex blobIndex
+
+	// background is the context of background uploads and outbox replays; Flush cancels it.
+	background       context.Context
+	cancelBackground context.CancelFunc
+	pending          sync.WaitGroup
+	// flushing is set by Flush, after which no more work is added to pending, see begin
+	pendingMu sync.Mutex
+	flushing  bool
 }
 
+// errFlushing is returned for uploads that arrive after Flush was called, e.g. from requests still running after
+// Shutdown gave up on them.
+var errFlushing = errors.New("server is shutting down")
+
 func NewServer(logger *slog.Logger, client client.Interface, opts Options) *Server {
-	return &Server{
-		opts:   opts,
-		cl:     client,
-		logger: logger,
+	m := newMetrics()
+	s := &Server{
+		opts:    opts,
+		cl:      &instrumentedClient{Interface: client, m: m},
+		logger:  logger,
+		metrics: m,
+	}
+	s.background, s.cancelBackground = context.WithCancel(context.Background())
+	if opts.AsyncUploads {
+		s.uploader = newUploader(s, opts.UploadWorkers, opts.UploadQueueSize)
+	}
+	if opts.BlobStore != nil {
+		s.blobs = &instrumentedBlobStore{BlobStore: opts.BlobStore, m: m}
 	}
+	return s
 }
 
 func (s *Server) CreateHandler() http.Handler {
 	r := mux.NewRouter()
-	api := r.PathPrefix("/v8/artifacts").Subrouter()
+	r.HandleFunc("/metrics", s.metricsHandler).Methods("GET")
 
+	api := r.PathPrefix("/v8/artifacts").Subrouter()
 	if s.opts.Token != "" {
-		api.Use(func(next http.Handler) http.Handler {
-			expectedHeader := fmt.Sprintf("Bearer %s", s.opts.Token)
-
-			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				if r.Header.Get("Authorization") != expectedHeader {
-					s.logger.Error("[tbc] authorization error")
-
-					http.Error(w, "Forbidden", http.StatusForbidden)
-					return
-				}
-				next.ServeHTTP(w, r)
-			})
-		})
+		api.Use(s.requireToken(http.StatusForbidden))
 	}
 
+	m := s.metrics
+	api.HandleFunc("", m.instrument(opQuery, s.queryArtifactsHandler)).Methods("POST")
 	api.HandleFunc("/events", s.eventsHandler).Methods("POST")
 	api.HandleFunc("/status", s.statusHandler).Methods("GET")
-	api.HandleFunc("/{hash}", s.uploadArtifactHandler).Methods("PUT")
-	api.HandleFunc("/{hash}", s.artifactExistsHandler).Methods("HEAD")
-	api.HandleFunc("/{hash}", s.downloadArtifactHandler).Methods("GET")
+	api.HandleFunc("/{hash}", m.instrument(opUpload, s.uploadArtifactHandler)).Methods("PUT")
+	api.HandleFunc("/{hash}", m.instrument(opExists, s.artifactExistsHandler)).Methods("HEAD")
+	api.HandleFunc("/{hash}", m.instrument(opDownload, s.downloadArtifactHandler)).Methods("GET")
+
+	// Nx self-hosted remote cache API
+	nx := r.PathPrefix("/v1/cache").Subrouter()
+	if s.opts.Token != "" {
+		nx.Use(s.requireToken(http.StatusUnauthorized))
+	}
+	nx.HandleFunc("/{hash}", m.instrument(opUpload, s.nxUploadHandler)).Methods("PUT")
+	nx.HandleFunc("/{hash}", m.instrument(opDownload, s.nxDownloadHandler)).Methods("GET")
+
+	if s.opts.GradlePrefix != "" {
+		gradle := r.PathPrefix(s.opts.GradlePrefix).Subrouter()
+		if s.opts.Token != "" {
+			gradle.Use(s.requireCredentials)
+		}
+		gradle.HandleFunc("/{key}", m.instrument(opUpload, s.gradleUploadHandler)).Methods("PUT")
+		gradle.HandleFunc("/{key}", m.instrument(opDownload, s.gradleDownloadHandler)).Methods("GET")
+	}
+
+	if s.blobs != nil {
+		bazel := r.NewRoute().Subrouter()
+		if s.opts.Token != "" {
+			bazel.Use(s.requireCredentials)
+		}
+		const hash = "/{hash:[0-9a-f]{64}}"
+		bazel.HandleFunc("/ac"+hash, m.instrument(opUpload, s.acUploadHandler)).Methods("PUT")
+		bazel.HandleFunc("/ac"+hash, m.instrument(opExists, s.acDownloadHandler)).Methods("HEAD")
+		bazel.HandleFunc("/ac"+hash, m.instrument(opDownload, s.acDownloadHandler)).Methods("GET")
+		bazel.HandleFunc("/cas"+hash, m.instrument(opUpload, s.casUploadHandler)).Methods("PUT")
+		bazel.HandleFunc("/cas"+hash, m.instrument(opExists, s.casDownloadHandler)).Methods("HEAD")
+		bazel.HandleFunc("/cas"+hash, m.instrument(opDownload, s.casDownloadHandler)).Methods("GET")
+	}
 
 	return r
 }
 
-func (*Server) eventsHandler(w http.ResponseWriter, _ *http.Request) {
-	w.WriteHeader(http.StatusOK)
+// requireToken rejects requests without Options.Token with status.
+func (s *Server) requireToken(status int) mux.MiddlewareFunc {
+	expectedHeader := fmt.Sprintf("Bearer %s", s.opts.Token)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expectedHeader)) != 1 {
+				s.logger.Error("[tbc] authorization error")
+
+				http.Error(w, http.StatusText(status), status)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireCredentials rejects requests without Options.Token. For clients that only support basic authentication
+// (Gradle, Bazel), the token is accepted as the password with any user name, as well as a bearer token.
+func (s *Server) requireCredentials(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, password, ok := r.BasicAuth(); ok &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(s.opts.Token)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.opts.Token)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		s.logger.Error("[tbc] authorization error")
+		w.Header().Set("WWW-Authenticate", `Basic realm="tbc"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
 }
 
 func (*Server) statusHandler(w http.ResponseWriter, _ *http.Request) {
@@ -82,48 +207,218 @@ func (*Server) statusHandler(w http.ResponseWriter, _ *http.Request) {
 	})
 }
 
+// artifactInfo is a single entry of the POST /v8/artifacts response.
+type artifactInfo struct {
+	Size           int64  `json:"size"`
+	TaskDurationMs int64  `json:"taskDurationMs"`
+	Tag            string `json:"tag,omitempty"`
+}
+
+func (s *Server) metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.metrics.write(w, s.GetStatistics())
+}
+
+func (s *Server) queryArtifactsHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Hashes []string `json:"hashes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	if !s.opts.Mode.canRead() {
+		s.record(Stats{SkippedLookupCount: len(req.Hashes)})
+
+		result := make(map[string]*artifactInfo, len(req.Hashes))
+		for _, hash := range req.Hashes {
+			result[hash] = nil
+		}
+		w.Header().Set("Content-Type", "application/json")
+		jsonBody(w, result)
+		return
+	}
+
+	keys := make([]string, len(req.Hashes))
+	for i, hash := range req.Hashes {
+		var err error
+		if keys[i], err = makeKey(hash, r.URL.Query()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	found, err := s.cl.StatFiles(makeContext(r.Context(), r), keys)
+	if err != nil {
+		http.Error(w, "Error looking up files", http.StatusInternalServerError)
+		s.logError(err)
+		return
+	}
+
+	result := make(map[string]*artifactInfo, len(req.Hashes))
+	for i, hash := range req.Hashes {
+		info, ok := found[keys[i]]
+		if !ok {
+			s.record(Stats{ExistsNoCount: 1})
+			result[hash] = nil
+			continue
+		}
+
+		s.record(Stats{ExistsYesCount: 1})
+		ai := &artifactInfo{Size: max(info.Size, 0)}
+		if v, ok := info.Metadata["x-artifact-duration"].(string); ok {
+			ai.TaskDurationMs, _ = strconv.ParseInt(v, 10, 64)
+		}
+		if v, ok := info.Metadata["x-artifact-tag"].(string); ok {
+			ai.Tag = v
+		}
+		result[hash] = ai
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	jsonBody(w, result)
+}
+
 func (s *Server) uploadArtifactHandler(w http.ResponseWriter, r *http.Request) {
 	key := getKey(w, r)
 	if key == "" {
 		return
 	}
 
+	if s.discardUpload(w, r, turboUploads) {
+		return
+	}
+
+	var src io.Reader = r.Body
+	if s.opts.SignatureKey != "" {
+		tv, err := s.newTagVerifier(r, r.Header.Get("X-Artifact-Tag"))
+		if err != nil {
+			s.rejectUpload(w, err)
+			return
+		}
+		src = &verifyingReader{r: r.Body, tv: tv}
+	}
+	s.storeUpload(w, r, key, src, collectMetadata(r.Header), turboUploads)
+}
+
+// uploadResponses are the protocol-specific responses to uploads.
+type uploadResponses struct {
+	accepted func(w http.ResponseWriter)
+	// If set, responds to uploads exceeding Options.MaxUploadSize. Otherwise, they are accepted.
+	tooLarge func(w http.ResponseWriter)
+}
+
+var turboUploads = uploadResponses{accepted: acceptUpload}
+
+// discardUpload discards the upload if it must not be stored due to Options.Mode or the limits. Clients would
+// log errors if the upload failed, so success is reported. Returns true if the upload was discarded.
+func (s *Server) discardUpload(w http.ResponseWriter, r *http.Request, resp uploadResponses) bool {
+	if !s.opts.Mode.canWrite() {
+		s.skipUpload(w, r, Stats{SkippedUploadCount: 1}, resp)
+		return true
+	}
+	if delta, skip := limitError(s.checkLimits(r.ContentLength, r.Header)); skip {
+		s.skipUpload(w, r, delta, resp)
+		return true
+	}
+	return false
+}
+
+// storeUpload uploads src, which is the body of r, possibly wrapped, under key.
+func (s *Server) storeUpload(
+	w http.ResponseWriter, r *http.Request, key string, src io.Reader, md client.Metadata, resp uploadResponses,
+) {
 	reportError := func(msg string, err error) {
-		http.Error(w, "unable to upload", http.StatusInternalServerError)
+		http.Error(w, msgUploadFailed, http.StatusInternalServerError)
 		s.logError(err)
 	}
 
-	uploadedFile, err := os.CreateTemp("", "tbc-upload-*.tmp")
+	if r.ContentLength < 0 && s.hasSizeLimits() {
+		src = &limitReader{r: src, min: s.opts.MinUploadSize, max: s.opts.MaxUploadSize}
+	}
+
+	var (
+		ctx  = makeContext(r.Context(), r)
+		body = &countingReader{r: src}
+		err  error
+	)
+	if s.uploader != nil {
+		// the upload is counted when it's done
+		err = s.uploader.enqueue(ctx, key, body, md)
+	} else {
+		err = s.upload(ctx, key, body, r.ContentLength, md)
+	}
 	if err != nil {
-		reportError("error creating a temp file", err)
+		if errors.Is(err, errBadSignature) {
+			s.rejectUpload(w, err)
+			return
+		}
+		if delta, skip := limitError(err); skip {
+			s.skipUpload(w, r, delta, resp)
+			return
+		}
+
+		reportError("error uploading file", err)
 		return
 	}
 
-	defer func() {
-		_ = uploadedFile.Close()
-		_ = os.Remove(uploadedFile.Name())
-	}()
+	resp.accepted(w)
+}
 
-	size, err := io.Copy(uploadedFile, r.Body)
-	if err != nil {
-		reportError("error saving uploaded file", err)
-		return
+// upload uploads the artifact right away. If that fails and there is an outbox, the artifact is kept there
+// and the upload is considered accepted.
+func (s *Server) upload(ctx context.Context, key string, body *countingReader, size int64, md client.Metadata) error {
+	// A request still running after Shutdown gave up on it has already been counted as abandoned.
+	if !s.begin() {
+		return errFlushing
+	}
+	defer s.pending.Done()
+	// like background uploads, the upload is aborted if Flush times out
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(s.background, cancel)()
+
+	if s.opts.Outbox == nil {
+		if err := s.cl.UploadReader(ctx, key, body, size, "", md); err != nil {
+			return err
+		}
+		s.record(Stats{UploadCount: 1, UploadedBytes: body.n})
+		return nil
 	}
 
-	err = uploadedFile.Close()
+	entry, err := s.opts.Outbox.Create()
 	if err != nil {
-		reportError("error closing uploaded file", err)
-		return
+		return err
+	}
+	err = s.cl.UploadReader(ctx, key, io.TeeReader(body, entry), size, "", md)
+	if err == nil {
+		entry.Discard()
+		s.record(Stats{UploadCount: 1, UploadedBytes: body.n})
+		return nil
+	}
+	if _, skip := limitError(err); skip || errors.Is(err, errBadSignature) {
+		entry.Discard()
+		return err
 	}
 
-	err = s.cl.UploadFile(makeContext(r.Context(), r), key, uploadedFile.Name(), collectMetadata(r.Header))
-	if err != nil {
-		reportError("error uploading file", err)
-		return
+	// the remote cache could have stopped reading halfway, so keep the rest of the body too
+	if _, copyErr := io.Copy(entry, body); copyErr != nil {
+		entry.Discard()
+		return errors.Join(err, copyErr)
+	}
+	if commitErr := entry.Commit(key, md); commitErr != nil {
+		entry.Discard()
+		return errors.Join(err, commitErr)
 	}
+	entry.Release()
 
-	s.stats.UploadCount++
-	s.stats.UploadedBytes += size
+	s.logError(err)
+	s.record(Stats{OutboxedCount: 1})
+	return nil
+}
+
+func acceptUpload(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusAccepted)
 	jsonBody(w, struct {
 		Urls []string `json:"urls"`
@@ -135,6 +430,12 @@ func (s *Server) artifactExistsHandler(w http.ResponseWriter, r *http.Request) {
 	if key == "" {
 		return
 	}
+
+	if !s.opts.Mode.canRead() {
+		s.record(Stats{SkippedLookupCount: 1})
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	ok, err := s.cl.FindFile(makeContext(r.Context(), r), key)
 
 	if err != nil {
@@ -144,10 +445,10 @@ func (s *Server) artifactExistsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if ok {
-		s.stats.ExistsYesCount++
+		s.record(Stats{ExistsYesCount: 1})
 		w.WriteHeader(http.StatusOK)
 	} else {
-		s.stats.ExistsNoCount++
+		s.record(Stats{ExistsNoCount: 1})
 		w.WriteHeader(http.StatusNotFound)
 	}
 }
@@ -157,28 +458,84 @@ func (s *Server) downloadArtifactHandler(w http.ResponseWriter, r *http.Request)
 	if key == "" {
 		return
 	}
+	s.serveArtifact(w, r, key, s.opts.SignatureKey != "")
+}
+
+// serveArtifact streams the artifact stored under key. If verify is set, its x-artifact-tag is verified.
+func (s *Server) serveArtifact(w http.ResponseWriter, r *http.Request, key string, verify bool) {
+	if !s.opts.Mode.canRead() {
+		s.record(Stats{SkippedLookupCount: 1})
+		http.Error(w, msgKeyNotFound, http.StatusNotFound)
+		return
+	}
 
 	reportError := func(msg string, err error) {
-		http.Error(w, "unable to download", http.StatusInternalServerError)
+		http.Error(w, msgDownloadFailed, http.StatusInternalServerError)
 		s.logError(err)
 	}
-
-	downloadedFile, err := os.CreateTemp("", "tbc-download-*.tmp")
-	if err != nil {
-		reportError("error creating a temp file", err)
-		return
+	reportNotFound := func() {
+		http.Error(w, msgKeyNotFound, http.StatusNotFound)
+		s.record(Stats{DownloadNotFoundCount: 1})
 	}
 
-	defer func() {
-		_ = downloadedFile.Close()
-		_ = os.Remove(downloadedFile.Name())
-	}()
+	var (
+		body     = &countingWriter{w: w}
+		tv       *tagVerifier
+		hold     *holdbackWriter
+		rejected error
+	)
+	open := func(info client.ArtifactInfo) (io.Writer, error) {
+		var dst io.Writer = body
+		if verify {
+			tag, _ := info.Metadata["x-artifact-tag"].(string)
+			var err error
+			if tv, err = s.newTagVerifier(r, tag); err != nil {
+				rejected = err
+				return nil, err
+			}
+			hold = &holdbackWriter{w: body}
+			dst = io.MultiWriter(tv, hold)
+		}
+
+		// The artifact is streamed as it arrives from the cache, so unlike http.ServeContent, Range requests are not
+		// supported. turbo doesn't send them.
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Accept-Ranges", "none")
+		if info.Size >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		}
+		for k, v := range info.Metadata {
+			if v, ok := v.(string); ok {
+				w.Header().Set(k, v)
+			}
+		}
+		return dst, nil
+	}
 
-	md, err := s.cl.DownloadFile(makeContext(r.Context(), r), key, downloadedFile)
+	ctx := makeContext(r.Context(), r)
+	err := s.cl.StreamFile(ctx, key, open)
+	if rejected != nil {
+		s.rejectDownload(w, rejected)
+		return
+	}
+	if err == nil && tv != nil {
+		if err = tv.verify(); err != nil {
+			s.record(Stats{SignatureRejectedCount: 1})
+		} else {
+			err = hold.flush()
+		}
+	}
 	if err != nil {
-		if st, ok := status.FromError(err); ok && st.Code() == codes.NotFound {
-			http.Error(w, "key not found", http.StatusNotFound)
-			s.stats.DownloadNotFoundCount++
+		if body.n > 0 {
+			// The response is already on its way, so the only way to signal the error is to abort the connection.
+			// Otherwise, turbo would get a truncated artifact.
+			s.logError(err)
+			panic(http.ErrAbortHandler)
+		}
+
+		w.Header().Del("Content-Length")
+		if isNotFound(err) || errors.Is(err, errBadSignature) {
+			reportNotFound()
 			return
 		}
 
@@ -186,16 +543,30 @@ func (s *Server) downloadArtifactHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	for k, v := range md {
-		if v, ok := v.(string); ok {
-			w.Header().Set(k, v)
-		}
-	}
+	s.record(Stats{DownloadCount: 1, DownloadedBytes: body.n})
+}
+
+// newTagVerifier creates a verifier for the artifact addressed by r.
+func (s *Server) newTagVerifier(r *http.Request, tag string) (*tagVerifier, error) {
+	return newTagVerifier(s.opts.SignatureKey, mux.Vars(r)["hash"], r.URL.Query().Get("teamId"), tag)
+}
+
+func (s *Server) rejectUpload(w http.ResponseWriter, err error) {
+	s.record(Stats{SignatureRejectedCount: 1})
+	s.logger.Error("[tbc] rejected upload", slog.String("err", err.Error()))
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// rejectDownload reports a miss so that turbo rebuilds the artifact and replaces it with a properly signed one.
+func (s *Server) rejectDownload(w http.ResponseWriter, err error) {
+	s.record(Stats{SignatureRejectedCount: 1, DownloadNotFoundCount: 1})
+	s.logger.Error("[tbc] rejected download", slog.String("err", err.Error()))
+	http.Error(w, msgKeyNotFound, http.StatusNotFound)
+}
 
-	s.stats.DownloadCount++
-	s.stats.DownloadedBytes += getFileSize(downloadedFile)
-	http.ServeContent(w, r, "", time.UnixMilli(0), downloadedFile)
+func isNotFound(err error) bool {
+	st, ok := status.FromError(err)
+	return ok && st.Code() == codes.NotFound
 }
 
 func makeContext(ctx context.Context, r *http.Request) context.Context {
@@ -207,7 +578,7 @@ func makeContext(ctx context.Context, r *http.Request) context.Context {
 
 // nolint: contextcheck
 func (s *Server) logError(err error) {
-	s.stats.ErrorsCount++
+	s.record(Stats{ErrorsCount: 1})
 
 	var attrs []slog.Attr
 	for k, v := range fctx.Unwrap(err) {
@@ -217,11 +588,94 @@ func (s *Server) logError(err error) {
 	s.logger.LogAttrs(context.Background(), slog.LevelError, fmt.Sprintf("[tbc] %+v", err), attrs...)
 }
 
+// ReplayOutbox starts uploading the entries of Options.Outbox in the background. See Flush.
+func (s *Server) ReplayOutbox() {
+	if s.opts.Outbox == nil || !s.opts.Mode.canWrite() || !s.begin() {
+		return
+	}
+
+	go func() {
+		defer s.pending.Done()
+
+		err := s.opts.Outbox.Replay(s.background, s.cl, func(key string, err error) {
+			switch {
+			case err == nil:
+				s.record(Stats{OutboxReplayedCount: 1})
+			case s.background.Err() == nil:
+				s.record(Stats{OutboxReplayFailedCount: 1})
+				s.logError(err)
+			}
+		})
+		if err != nil && s.background.Err() == nil {
+			s.logError(err)
+		}
+	}()
+}
+
+// Shutdown gracefully shuts down httpSrv, which serves the handler of the server, waiting for in-flight requests.
+// If ctx is done first, the remaining connections are closed and the requests are counted as abandoned.
+// Background uploads are not waited for, see Flush.
+func (s *Server) Shutdown(ctx context.Context, httpSrv *http.Server) error {
+	err := httpSrv.Shutdown(ctx)
+	if err != nil {
+		s.record(Stats{AbandonedRequestCount: s.metrics.inFlightTotal()})
+		_ = httpSrv.Close()
+	}
+	return err
+}
+
+// Flush waits for background uploads and the outbox replay to finish, as well as for uploads of requests that
+// Shutdown gave up on. If ctx is done first, they are aborted; the remaining uploads are counted as abandoned.
+// Uploads arriving after Flush was called are abandoned right away.
+func (s *Server) Flush(ctx context.Context) error {
+	s.pendingMu.Lock()
+	s.flushing = true
+	s.pendingMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.cancelBackground()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// begin adds a task to pending, unless Flush has been called. Returns false in that case.
+func (s *Server) begin() bool {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+
+	if s.flushing {
+		return false
+	}
+	s.pending.Add(1)
+	return true
+}
+
+// record adds delta to the server statistics.
+func (s *Server) record(delta Stats) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	s.stats.add(delta)
+}
+
 func (s *Server) GetStatistics() Stats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
 	return s.stats
 }
 
 func (s *Server) ResetStatistics() {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
 	s.stats = Stats{}
 }
 
@@ -240,7 +694,17 @@ func getKey(w http.ResponseWriter, r *http.Request) string {
 		return ""
 	}
 
-	query := r.URL.Query()
+	key, err := makeKey(hash, r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ""
+	}
+	return key
+}
+
+// makeKey scopes hash with teamId and slug query parameters. The parts must not contain "/", which separates them,
+// or ":", which separates the namespaces of the other protocols (see nxKeyPrefix), so that keys can't collide.
+func makeKey(hash string, query url.Values) (string, error) {
 	keyParts := []string{hash}
 	if query.Has("teamId") {
 		keyParts = append([]string{query.Get("teamId")}, keyParts...)
@@ -248,7 +712,12 @@ func getKey(w http.ResponseWriter, r *http.Request) string {
 	if query.Has("slug") {
 		keyParts = append([]string{query.Get("slug")}, keyParts...)
 	}
-	return strings.Join(keyParts, "/")
+	for _, part := range keyParts {
+		if strings.ContainsAny(part, "/:") {
+			return "", fmt.Errorf("invalid key part %q", part)
+		}
+	}
+	return strings.Join(keyParts, "/"), nil
 }
 
 var headersForMetadata = []string{
@@ -268,7 +737,26 @@ func collectMetadata(h http.Header) (md client.Metadata) {
 	return
 }
 
-func getFileSize(f *os.File) int64 {
-	ret, _ := f.Seek(0, io.SeekEnd)
-	return ret
+// countingReader counts bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
 }
@@ -2,17 +2,29 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/be9/tbc/client"
+	"google.golang.org/protobuf/proto"
 	"gotest.tools/v3/assert"
 )
 
@@ -41,6 +53,47 @@ func TestEvents(t *testing.T) {
 	assert.Equal(t, rr.Code, http.StatusOK)
 }
 
+func TestEventsStatistics(t *testing.T) {
+	var (
+		eventsLog bytes.Buffer
+		srv       = NewServer(slog.Default(), client.NewInMemoryClient(), Options{EventsLog: &eventsLog})
+		r         = srv.CreateHandler()
+	)
+	const events = `[
+		{"sessionId": "s1", "source": "LOCAL", "event": "HIT", "hash": "h1", "duration": 100},
+		{"sessionId": "s1", "source": "LOCAL", "event": "MISS", "hash": "h2", "duration": 0},
+		{"sessionId": "s1", "source": "REMOTE", "event": "HIT", "hash": "h2", "duration": 250},
+		{"sessionId": "s1", "source": "REMOTE", "event": "MISS", "hash": "h3", "duration": 0}
+	]`
+
+	req, err := http.NewRequest("POST", "/v8/artifacts/events", strings.NewReader(events))
+	assert.NilError(t, err)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	assert.Equal(t, rr.Code, http.StatusOK)
+	assert.DeepEqual(t, srv.GetStatistics(), Stats{
+		LocalHitCount:   1,
+		LocalMissCount:  1,
+		RemoteHitCount:  1,
+		RemoteMissCount: 1,
+		TimeSavedMs:     350,
+	})
+
+	lines := strings.Split(strings.TrimSpace(eventsLog.String()), "\n")
+	assert.Equal(t, len(lines), 4)
+	assert.Assert(t, strings.Contains(lines[2], `"sessionId":"s1","source":"REMOTE","event":"HIT","hash":"h2","duration":250}`))
+
+	t.Run("malformed", func(t *testing.T) {
+		req, err := http.NewRequest("POST", "/v8/artifacts/events", strings.NewReader("{"))
+		assert.NilError(t, err)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+
+		assert.Equal(t, rr.Code, http.StatusBadRequest)
+	})
+}
+
 func TestStatus(t *testing.T) {
 	r, _ := createHandler("")
 
@@ -170,6 +223,29 @@ func TestCheck(t *testing.T) {
 	})
 }
 
+func TestQuery(t *testing.T) {
+	cl := client.NewInMemoryClient()
+	uploadFile(t, cl, "slug/teamid/key1", []byte("DATA"), client.Metadata{
+		"x-artifact-duration": "42",
+		"x-artifact-tag":      "hmac tag",
+	})
+	uploadFile(t, cl, "slug/teamid/key2", []byte("MORE DATA"), nil)
+
+	r, srv := createHandlerForClient("", cl)
+
+	req, err := http.NewRequest("POST", "/v8/artifacts?teamId=teamid&slug=slug",
+		strings.NewReader(`{"hashes": ["key1", "key2", "key3"]}`))
+	assert.NilError(t, err)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	assert.Equal(t, rr.Code, http.StatusOK)
+	assert.Equal(t, rr.Body.String(),
+		`{"key1":{"size":4,"taskDurationMs":42,"tag":"hmac tag"},"key2":{"size":9,"taskDurationMs":0},"key3":null}`+"\n")
+	assert.DeepEqual(t, srv.GetStatistics(), Stats{ExistsYesCount: 2, ExistsNoCount: 1})
+}
+
 func TestDownload(t *testing.T) {
 	cl := client.NewInMemoryClient()
 	randomContent := randomBytes(t, 4096)
@@ -221,6 +297,828 @@ func TestDownload(t *testing.T) {
 	})
 }
 
+func TestDownloadRecompressed(t *testing.T) {
+	cl, err := client.NewCodecClient(client.NewInMemoryClient(), "zstd")
+	assert.NilError(t, err)
+	r, _ := createHandlerForClient("", cl)
+
+	var artifact bytes.Buffer
+	zw := gzip.NewWriter(&artifact)
+	_, _ = zw.Write(bytes.Repeat([]byte("DATA"), 1000))
+	assert.NilError(t, zw.Close())
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, createBaseUploadRequest(t, "key", bytes.NewReader(artifact.Bytes())))
+	assert.Equal(t, rr.Code, http.StatusAccepted)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, createDownloadRequest(t, "key"))
+	assert.Equal(t, rr.Code, http.StatusOK)
+	assert.Equal(t, rr.Header().Get("Content-Length"), strconv.Itoa(rr.Body.Len()))
+	assert.Equal(t, rr.Header().Get("Tbc-Codec"), "")
+	assert.Equal(t, rr.Header().Get("Tbc-Original-Size"), "")
+
+	zr, err := gzip.NewReader(rr.Body)
+	assert.NilError(t, err)
+	content, err := io.ReadAll(zr)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, content, bytes.Repeat([]byte("DATA"), 1000))
+}
+
+func TestDownloadStreaming(t *testing.T) {
+	content := randomBytes(t, 64*1024)
+	cl := &truncatingClient{InMemoryClient: client.NewInMemoryClient()}
+	uploadFile(t, cl, "key", content, nil)
+
+	handler, srv := createHandlerForClient("", cl)
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	t.Run("content length is set", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/v8/artifacts/key")
+		assert.NilError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		assert.Equal(t, resp.ContentLength, int64(len(content)))
+
+		body, err := io.ReadAll(resp.Body)
+		assert.NilError(t, err)
+		assert.Equal(t, bytes.Equal(body, content), true)
+	})
+
+	t.Run("mid-stream error aborts the connection", func(t *testing.T) {
+		srv.ResetStatistics()
+		cl.truncate = true
+
+		resp, err := http.Get(ts.URL + "/v8/artifacts/key")
+		assert.NilError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		_, err = io.ReadAll(resp.Body)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		assert.DeepEqual(t, srv.GetStatistics(), Stats{ErrorsCount: 1})
+	})
+}
+
+func TestSignatureVerification(t *testing.T) {
+	const signatureKey = "super_secret"
+
+	var (
+		cl      = client.NewInMemoryClient()
+		srv     = NewServer(slog.Default(), cl, Options{SignatureKey: signatureKey})
+		handler = srv.CreateHandler()
+		content = randomBytes(t, 64*1024)
+		tag     = signArtifact(signatureKey, "key", "team", content)
+	)
+
+	t.Run("good upload", func(t *testing.T) {
+		srv.ResetStatistics()
+		req := createBaseUploadRequest(t, "key?teamId=team", bytes.NewBuffer(content))
+		req.Header.Set("X-Artifact-Tag", tag)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(t, rr.Code, http.StatusAccepted)
+		assert.DeepEqual(t, srv.GetStatistics(), Stats{UploadCount: 1, UploadedBytes: int64(len(content))})
+	})
+
+	t.Run("bad uploads", func(t *testing.T) {
+		srv.ResetStatistics()
+		for _, tc := range []struct{ key, tag string }{
+			{"key2?teamId=team", tag},  // signed for another hash
+			{"key?teamId=team2", tag},  // signed for another team
+			{"key?teamId=team", ""},    // unsigned
+			{"key?teamId=team", "???"}, // malformed
+		} {
+			req := createBaseUploadRequest(t, tc.key, bytes.NewBuffer(content))
+			req.Header.Set("X-Artifact-Tag", tc.tag)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, rr.Code, http.StatusBadRequest)
+		}
+
+		ok, err := cl.FindFile(context.Background(), "team/key2")
+		assert.NilError(t, err)
+		assert.Equal(t, ok, false)
+		assert.DeepEqual(t, srv.GetStatistics(), Stats{SignatureRejectedCount: 4})
+	})
+
+	t.Run("good download", func(t *testing.T) {
+		srv.ResetStatistics()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, createDownloadRequest(t, "key?teamId=team"))
+
+		assert.Equal(t, rr.Code, http.StatusOK)
+		assert.Equal(t, bytes.Equal(rr.Body.Bytes(), content), true)
+		assert.DeepEqual(t, srv.GetStatistics(), Stats{DownloadCount: 1, DownloadedBytes: int64(len(content))})
+	})
+
+	t.Run("unsigned download", func(t *testing.T) {
+		uploadFile(t, cl, "team/unsigned", content, nil)
+
+		srv.ResetStatistics()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, createDownloadRequest(t, "unsigned?teamId=team"))
+
+		assert.Equal(t, rr.Code, http.StatusNotFound)
+		assert.DeepEqual(t, srv.GetStatistics(), Stats{SignatureRejectedCount: 1, DownloadNotFoundCount: 1})
+	})
+
+	t.Run("poisoned download", func(t *testing.T) {
+		poisoned := bytes.Clone(content)
+		poisoned[len(poisoned)-1]++
+		uploadFile(t, cl, "team/key", poisoned, client.Metadata{"x-artifact-tag": tag})
+
+		ts := httptest.NewServer(handler)
+		defer ts.Close()
+
+		srv.ResetStatistics()
+		resp, err := http.Get(ts.URL + "/v8/artifacts/key?teamId=team")
+		assert.NilError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+
+		body, err := io.ReadAll(resp.Body)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		assert.Equal(t, len(body), len(content)-1)
+		assert.DeepEqual(t, srv.GetStatistics(), Stats{SignatureRejectedCount: 1, ErrorsCount: 1})
+	})
+}
+
+// writeCounter counts the calls to Write.
+type writeCounter struct {
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+func TestHoldbackWriter(t *testing.T) {
+	var (
+		wc   writeCounter
+		hold = &holdbackWriter{w: &wc}
+	)
+	_, err := hold.Write([]byte("D"))
+	assert.NilError(t, err)
+	assert.Equal(t, wc.writes, 0)
+
+	_, err = hold.Write([]byte("ATA"))
+	assert.NilError(t, err)
+	assert.Equal(t, wc.writes, 1)
+
+	assert.NilError(t, hold.flush())
+	assert.Equal(t, wc.writes, 2)
+}
+
+func TestModes(t *testing.T) {
+	cl := client.NewInMemoryClient()
+	uploadFile(t, cl, "key", []byte("DATA"), nil)
+
+	t.Run("read-only", func(t *testing.T) {
+		srv := NewServer(slog.Default(), cl, Options{Mode: ModeReadOnly})
+		r := srv.CreateHandler()
+
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, createBaseUploadRequest(t, "new", bytes.NewBufferString("DATA")))
+		assert.Equal(t, rr.Code, http.StatusAccepted)
+
+		ok, err := cl.FindFile(context.Background(), "new")
+		assert.NilError(t, err)
+		assert.Equal(t, ok, false)
+
+		rr = httptest.NewRecorder()
+		r.ServeHTTP(rr, createDownloadRequest(t, "key"))
+		assert.Equal(t, rr.Code, http.StatusOK)
+
+		assert.DeepEqual(t, srv.GetStatistics(), Stats{SkippedUploadCount: 1, DownloadCount: 1, DownloadedBytes: 4})
+	})
+
+	t.Run("write-only", func(t *testing.T) {
+		srv := NewServer(slog.Default(), cl, Options{Mode: ModeWriteOnly})
+		r := srv.CreateHandler()
+
+		for _, req := range []*http.Request{createCheckRequest(t, "key"), createDownloadRequest(t, "key")} {
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			assert.Equal(t, rr.Code, http.StatusNotFound)
+		}
+
+		req, err := http.NewRequest("POST", "/v8/artifacts", strings.NewReader(`{"hashes": ["key"]}`))
+		assert.NilError(t, err)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		assert.Equal(t, rr.Body.String(), `{"key":null}`+"\n")
+
+		rr = httptest.NewRecorder()
+		r.ServeHTTP(rr, createBaseUploadRequest(t, "new", bytes.NewBufferString("DATA")))
+		assert.Equal(t, rr.Code, http.StatusAccepted)
+
+		ok, err := cl.FindFile(context.Background(), "new")
+		assert.NilError(t, err)
+		assert.Equal(t, ok, true)
+
+		assert.DeepEqual(t, srv.GetStatistics(), Stats{SkippedLookupCount: 3, UploadCount: 1, UploadedBytes: 4})
+	})
+}
+
+func TestUploadLimits(t *testing.T) {
+	opts := Options{MaxUploadSize: 8, MinUploadSize: 2, MinDuration: time.Second}
+
+	tests := []struct {
+		name          string
+		body          string
+		duration      string
+		unknownLength bool
+		stored        bool
+		stats         Stats
+	}{
+		{name: "within limits", body: "DATA", duration: "1500", stored: true, stats: Stats{UploadCount: 1, UploadedBytes: 4}},
+		{name: "no duration", body: "DATA", stored: true, stats: Stats{UploadCount: 1, UploadedBytes: 4}},
+		{name: "too large", body: "LARGE DATA", stats: Stats{SkippedTooLargeCount: 1}},
+		{name: "too small", body: "D", stats: Stats{SkippedTooSmallCount: 1}},
+		{name: "too fast", body: "DATA", duration: "999", stats: Stats{SkippedTooFastCount: 1}},
+		{name: "too large, unknown length", body: "LARGE DATA", unknownLength: true, stats: Stats{SkippedTooLargeCount: 1}},
+		{name: "too small, unknown length", body: "D", unknownLength: true, stats: Stats{SkippedTooSmallCount: 1}},
+		{name: "within limits, unknown length", body: "DATA", unknownLength: true, stored: true,
+			stats: Stats{UploadCount: 1, UploadedBytes: 4}},
+	}
+	for _, async := range []bool{false, true} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s, async=%v", tt.name, async), func(t *testing.T) {
+				cl := client.NewInMemoryClient()
+				opts.AsyncUploads = async
+				srv := NewServer(slog.Default(), cl, opts)
+
+				req := createBaseUploadRequest(t, "key", struct{ io.Reader }{strings.NewReader(tt.body)})
+				req.ContentLength = int64(len(tt.body))
+				if tt.unknownLength {
+					req.ContentLength = -1
+				}
+				if tt.duration != "" {
+					req.Header.Set("X-Artifact-Duration", tt.duration)
+				}
+				rr := httptest.NewRecorder()
+				srv.CreateHandler().ServeHTTP(rr, req)
+				assert.Equal(t, rr.Code, http.StatusAccepted)
+				assert.NilError(t, srv.Flush(context.Background()))
+
+				ok, err := cl.FindFile(context.Background(), "key")
+				assert.NilError(t, err)
+				assert.Equal(t, ok, tt.stored)
+				assert.DeepEqual(t, srv.GetStatistics(), tt.stats)
+			})
+		}
+	}
+}
+
+func TestAsyncUploads(t *testing.T) {
+	t.Run("successful uploads", func(t *testing.T) {
+		cl := client.NewInMemoryClient()
+		srv := NewServer(slog.Default(), cl, Options{AsyncUploads: true, UploadWorkers: 2})
+		r := srv.CreateHandler()
+
+		for i := 0; i < 10; i++ {
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, createBaseUploadRequest(t, fmt.Sprintf("key%d", i), bytes.NewBufferString("DATA")))
+			assert.Equal(t, rr.Code, http.StatusAccepted)
+		}
+
+		assert.NilError(t, srv.Flush(context.Background()))
+		for i := 0; i < 10; i++ {
+			ok, err := cl.FindFile(context.Background(), fmt.Sprintf("key%d", i))
+			assert.NilError(t, err)
+			assert.Equal(t, ok, true)
+		}
+		assert.DeepEqual(t, srv.GetStatistics(), Stats{UploadCount: 10, UploadedBytes: 40})
+	})
+
+	t.Run("failed uploads", func(t *testing.T) {
+		cl := &uploadHookClient{InMemoryClient: client.NewInMemoryClient(), hook: func(context.Context) error {
+			return errors.New("remote cache is down")
+		}}
+		srv := NewServer(slog.Default(), cl, Options{AsyncUploads: true})
+		r := srv.CreateHandler()
+
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, createBaseUploadRequest(t, "key", bytes.NewBufferString("DATA")))
+		assert.Equal(t, rr.Code, http.StatusAccepted)
+
+		assert.NilError(t, srv.Flush(context.Background()))
+		assert.DeepEqual(t, srv.GetStatistics(), Stats{AsyncUploadFailedCount: 1, ErrorsCount: 1})
+	})
+
+	t.Run("flush deadline", func(t *testing.T) {
+		cl := &uploadHookClient{InMemoryClient: client.NewInMemoryClient(), hook: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}}
+		srv := NewServer(slog.Default(), cl, Options{AsyncUploads: true, UploadWorkers: 1})
+		r := srv.CreateHandler()
+
+		for i := 0; i < 3; i++ {
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, createBaseUploadRequest(t, fmt.Sprintf("key%d", i), bytes.NewBufferString("DATA")))
+			assert.Equal(t, rr.Code, http.StatusAccepted)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, srv.Flush(ctx), context.DeadlineExceeded)
+		assert.DeepEqual(t, srv.GetStatistics(), Stats{AsyncUploadAbandonedCount: 3})
+	})
+}
+
+func TestOutbox(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		failing = func(context.Context) error { return errors.New("remote cache is down") }
+	)
+
+	for _, async := range []bool{false, true} {
+		t.Run(fmt.Sprintf("async=%v", async), func(t *testing.T) {
+			outbox, err := client.NewOutbox(t.TempDir())
+			assert.NilError(t, err)
+
+			cl := &uploadHookClient{InMemoryClient: client.NewInMemoryClient(), hook: failing}
+			srv := NewServer(slog.Default(), cl, Options{AsyncUploads: async, Outbox: outbox})
+
+			rr := httptest.NewRecorder()
+			req := createBaseUploadRequest(t, "key", bytes.NewBufferString("DATA"))
+			req.Header.Set("X-Artifact-Duration", "42")
+			srv.CreateHandler().ServeHTTP(rr, req)
+			assert.Equal(t, rr.Code, http.StatusAccepted)
+			assert.NilError(t, srv.Flush(ctx))
+
+			stats := srv.GetStatistics()
+			assert.Equal(t, stats.OutboxedCount, 1)
+			assert.Equal(t, stats.UploadCount, 0)
+
+			// the next run uploads the artifact
+			remote := client.NewInMemoryClient()
+			srv = NewServer(slog.Default(), remote, Options{Outbox: outbox})
+			srv.ReplayOutbox()
+			assert.NilError(t, srv.Flush(ctx))
+			assert.DeepEqual(t, srv.GetStatistics(), Stats{OutboxReplayedCount: 1})
+
+			var buf bytes.Buffer
+			md, err := remote.DownloadFile(ctx, "key", &buf)
+			assert.NilError(t, err)
+			assert.Equal(t, buf.String(), "DATA")
+			assert.DeepEqual(t, md, client.Metadata{"x-artifact-duration": "42"})
+
+			// nothing is left
+			srv = NewServer(slog.Default(), remote, Options{Outbox: outbox})
+			srv.ReplayOutbox()
+			assert.NilError(t, srv.Flush(ctx))
+			assert.DeepEqual(t, srv.GetStatistics(), Stats{})
+		})
+	}
+
+	t.Run("successful uploads are not kept", func(t *testing.T) {
+		outbox, err := client.NewOutbox(t.TempDir())
+		assert.NilError(t, err)
+
+		srv := NewServer(slog.Default(), client.NewInMemoryClient(), Options{Outbox: outbox})
+		rr := httptest.NewRecorder()
+		srv.CreateHandler().ServeHTTP(rr, createBaseUploadRequest(t, "key", bytes.NewBufferString("DATA")))
+		assert.Equal(t, rr.Code, http.StatusAccepted)
+		assert.DeepEqual(t, srv.GetStatistics(), Stats{UploadCount: 1, UploadedBytes: 4})
+
+		cl := &uploadHookClient{InMemoryClient: client.NewInMemoryClient(), hook: failing}
+		srv = NewServer(slog.Default(), cl, Options{Outbox: outbox})
+		srv.ReplayOutbox()
+		assert.NilError(t, srv.Flush(ctx))
+		assert.DeepEqual(t, srv.GetStatistics(), Stats{})
+	})
+
+	t.Run("failing to keep an upload is an error", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "outbox")
+		outbox, err := client.NewOutbox(dir)
+		assert.NilError(t, err)
+
+		// the entry can't be committed once its directory is gone
+		cl := &uploadHookClient{InMemoryClient: client.NewInMemoryClient(), hook: func(context.Context) error {
+			assert.NilError(t, os.RemoveAll(dir))
+			return errors.New("remote cache is down")
+		}}
+		srv := NewServer(slog.Default(), cl, Options{Outbox: outbox})
+		rr := httptest.NewRecorder()
+		srv.CreateHandler().ServeHTTP(rr, createBaseUploadRequest(t, "key", bytes.NewBufferString("DATA")))
+		assert.Equal(t, rr.Code, http.StatusInternalServerError)
+		assert.DeepEqual(t, srv.GetStatistics(), Stats{ErrorsCount: 1})
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	upload := func(t *testing.T, url string) {
+		req, err := http.NewRequest("PUT", url+"/v8/artifacts/key", bytes.NewBufferString("DATA"))
+		assert.NilError(t, err)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			_ = resp.Body.Close()
+		}
+	}
+
+	t.Run("waits for in-flight requests", func(t *testing.T) {
+		started, release := make(chan struct{}), make(chan struct{})
+		cl := &uploadHookClient{InMemoryClient: client.NewInMemoryClient(), hook: func(context.Context) error {
+			close(started)
+			<-release
+			return nil
+		}}
+		srv := NewServer(slog.Default(), cl, Options{})
+		ts := httptest.NewServer(srv.CreateHandler())
+		defer ts.Close()
+
+		go upload(t, ts.URL)
+		<-started
+
+		done := make(chan error)
+		go func() { done <- srv.Shutdown(context.Background(), ts.Config) }()
+		close(release)
+
+		assert.NilError(t, <-done)
+		assert.DeepEqual(t, srv.GetStatistics(), Stats{UploadCount: 1, UploadedBytes: 4})
+	})
+
+	t.Run("abandons requests at the deadline", func(t *testing.T) {
+		started := make(chan struct{})
+		cl := &uploadHookClient{InMemoryClient: client.NewInMemoryClient(), hook: func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		}}
+		srv := NewServer(slog.Default(), cl, Options{})
+		ts := httptest.NewServer(srv.CreateHandler())
+		defer ts.Close()
+
+		go upload(t, ts.URL)
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, srv.Shutdown(ctx, ts.Config), context.DeadlineExceeded)
+		assert.Equal(t, srv.GetStatistics().AbandonedRequestCount, 1)
+	})
+
+	t.Run("abandons uploads arriving after Flush", func(t *testing.T) {
+		for _, async := range []bool{false, true} {
+			cl := client.NewInMemoryClient()
+			srv := NewServer(slog.Default(), cl, Options{AsyncUploads: async})
+			r := srv.CreateHandler()
+			assert.NilError(t, srv.Flush(context.Background()))
+
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, createBaseUploadRequest(t, "key", bytes.NewBufferString("DATA")))
+			assert.Equal(t, rr.Code, http.StatusInternalServerError)
+
+			ok, err := cl.FindFile(context.Background(), "key")
+			assert.NilError(t, err)
+			assert.Assert(t, !ok)
+			if async {
+				assert.Equal(t, srv.GetStatistics().AsyncUploadAbandonedCount, 1)
+			}
+		}
+	})
+}
+
+func TestNx(t *testing.T) {
+	var (
+		cl      = client.NewInMemoryClient()
+		r, srv  = createHandlerForClient("secret", cl)
+		content = randomBytes(t, 4096)
+	)
+
+	nxRequest := func(method, hash string, body io.Reader) *http.Request {
+		req, err := http.NewRequest(method, "/v1/cache/"+hash, body)
+		assert.NilError(t, err)
+		req.Header.Set("Authorization", "Bearer secret")
+		return req
+	}
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, nxRequest("PUT", "hash", bytes.NewReader(content)))
+	assert.Equal(t, rr.Code, http.StatusOK)
+
+	t.Run("separate namespace", func(t *testing.T) {
+		ok, err := cl.FindFile(context.Background(), "nx:hash")
+		assert.NilError(t, err)
+		assert.Equal(t, ok, true)
+
+		for key, code := range map[string]int{
+			"hash":          http.StatusNotFound,
+			"hash?slug=nx":  http.StatusNotFound,
+			"nx:hash":       http.StatusBadRequest,
+			"hash?slug=nx:": http.StatusBadRequest,
+			"hash?slug=a/b": http.StatusBadRequest,
+		} {
+			rr := httptest.NewRecorder()
+			req := createDownloadRequest(t, key)
+			req.Header.Set("Authorization", "Bearer secret")
+			r.ServeHTTP(rr, req)
+			assert.Equal(t, rr.Code, code, key)
+		}
+	})
+
+	t.Run("download", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, nxRequest("GET", "hash", nil))
+		assert.Equal(t, rr.Code, http.StatusOK)
+		assert.DeepEqual(t, rr.Body.Bytes(), content)
+
+		rr = httptest.NewRecorder()
+		r.ServeHTTP(rr, nxRequest("GET", "unknown", nil))
+		assert.Equal(t, rr.Code, http.StatusNotFound)
+	})
+
+	t.Run("no overwrites", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, nxRequest("PUT", "hash", bytes.NewBufferString("DATA")))
+		assert.Equal(t, rr.Code, http.StatusConflict)
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		for _, method := range []string{"GET", "PUT"} {
+			req := nxRequest(method, "hash", bytes.NewBufferString("DATA"))
+			req.Header.Set("Authorization", "Bearer bad")
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			assert.Equal(t, rr.Code, http.StatusUnauthorized)
+		}
+	})
+
+	stats := srv.GetStatistics()
+	assert.Equal(t, stats.UploadCount, 1)
+	assert.Equal(t, stats.DownloadCount, 1)
+}
+
+func TestGradle(t *testing.T) {
+	var (
+		cl      = client.NewInMemoryClient()
+		srv     = NewServer(slog.Default(), cl, Options{Token: "secret", GradlePrefix: "/cache", MaxUploadSize: 8192})
+		r       = srv.CreateHandler()
+		content = randomBytes(t, 4096)
+	)
+
+	gradleRequest := func(method, key string, body io.Reader) *http.Request {
+		req, err := http.NewRequest(method, "/cache/"+key, body)
+		assert.NilError(t, err)
+		req.SetBasicAuth("gradle", "secret")
+		return req
+	}
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, gradleRequest("PUT", "key", bytes.NewReader(content)))
+	assert.Equal(t, rr.Code, http.StatusOK)
+
+	ok, err := cl.FindFile(context.Background(), "gradle:key")
+	assert.NilError(t, err)
+	assert.Equal(t, ok, true)
+
+	t.Run("download", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, gradleRequest("GET", "key", nil))
+		assert.Equal(t, rr.Code, http.StatusOK)
+		assert.DeepEqual(t, rr.Body.Bytes(), content)
+
+		rr = httptest.NewRecorder()
+		r.ServeHTTP(rr, gradleRequest("GET", "unknown", nil))
+		assert.Equal(t, rr.Code, http.StatusNotFound)
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, gradleRequest("PUT", "large", bytes.NewReader(randomBytes(t, 10000))))
+		assert.Equal(t, rr.Code, http.StatusRequestEntityTooLarge)
+
+		ok, err := cl.FindFile(context.Background(), "gradle:large")
+		assert.NilError(t, err)
+		assert.Equal(t, ok, false)
+	})
+
+	t.Run("bearer token", func(t *testing.T) {
+		req := gradleRequest("GET", "key", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		assert.Equal(t, rr.Code, http.StatusOK)
+	})
+
+	t.Run("bad credentials", func(t *testing.T) {
+		for _, method := range []string{"GET", "PUT"} {
+			req := gradleRequest(method, "key", bytes.NewBufferString("DATA"))
+			req.SetBasicAuth("gradle", "bad")
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			assert.Equal(t, rr.Code, http.StatusUnauthorized)
+			assert.Equal(t, rr.Header().Get("WWW-Authenticate"), `Basic realm="tbc"`)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		r, _ := createHandlerForClient("", cl)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, gradleRequest("GET", "key", nil))
+		assert.Equal(t, rr.Code, http.StatusNotFound)
+	})
+
+	stats := srv.GetStatistics()
+	assert.Equal(t, stats.UploadCount, 1)
+	assert.Equal(t, stats.DownloadCount, 2)
+	assert.Equal(t, stats.SkippedTooLargeCount, 1)
+}
+
+func TestBazelHTTP(t *testing.T) {
+	var (
+		blobs = client.NewInMemoryBlobStore()
+		srv   = NewServer(slog.Default(), client.NewInMemoryClient(), Options{Token: "secret", BlobStore: blobs})
+		r     = srv.CreateHandler()
+
+		content = randomBytes(t, 4096)
+		digest  = &remoteexecution.Digest{Hash: fmt.Sprintf("%x", sha256.Sum256(content)), SizeBytes: 4096}
+		action  = strings.Repeat("a", 64)
+	)
+
+	request := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		var rdr io.Reader
+		if body != nil {
+			rdr = bytes.NewReader(body)
+		}
+		req, err := http.NewRequest(method, path, rdr)
+		assert.NilError(t, err)
+		req.SetBasicAuth("bazel", "secret")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	arData, err := proto.Marshal(&remoteexecution.ActionResult{
+		OutputFiles: []*remoteexecution.OutputFile{{Path: "out", Digest: digest}},
+	})
+	assert.NilError(t, err)
+
+	assert.Equal(t, request("PUT", "/cas/"+digest.Hash, content).Code, http.StatusOK)
+	assert.Equal(t, request("PUT", "/ac/"+action, arData).Code, http.StatusOK)
+
+	t.Run("download", func(t *testing.T) {
+		rr := request("GET", "/ac/"+action, nil)
+		assert.Equal(t, rr.Code, http.StatusOK)
+		assert.DeepEqual(t, rr.Body.Bytes(), arData)
+
+		rr = request("GET", "/cas/"+digest.Hash, nil)
+		assert.Equal(t, rr.Code, http.StatusOK)
+		assert.DeepEqual(t, rr.Body.Bytes(), content)
+
+		assert.Equal(t, request("HEAD", "/cas/"+digest.Hash, nil).Code, http.StatusOK)
+		assert.Equal(t, request("GET", "/ac/"+strings.Repeat("b", 64), nil).Code, http.StatusNotFound)
+		assert.Equal(t, request("GET", "/ac/bad", nil).Code, http.StatusNotFound)
+	})
+
+	t.Run("sizes learned from action results", func(t *testing.T) {
+		// blobs uploaded by other clients are only found through the action results referencing them
+		other := []byte("stored by another client")
+		otherDigest := &remoteexecution.Digest{Hash: fmt.Sprintf("%x", sha256.Sum256(other)), SizeBytes: int64(len(other))}
+		assert.NilError(t, blobs.WriteBlob(context.Background(), otherDigest.Hash, otherDigest.SizeBytes, bytes.NewReader(other)))
+
+		otherAction := strings.Repeat("c", 64)
+		assert.NilError(t, blobs.UpdateActionResult(context.Background(), otherAction, &remoteexecution.ActionResult{
+			StdoutDigest: otherDigest,
+		}))
+
+		assert.Equal(t, request("GET", "/cas/"+otherDigest.Hash, nil).Code, http.StatusNotFound)
+		assert.Equal(t, request("GET", "/ac/"+otherAction, nil).Code, http.StatusOK)
+
+		rr := request("GET", "/cas/"+otherDigest.Hash, nil)
+		assert.Equal(t, rr.Code, http.StatusOK)
+		assert.DeepEqual(t, rr.Body.Bytes(), other)
+	})
+
+	t.Run("files of output directories", func(t *testing.T) {
+		file := []byte("file in an output directory")
+		fileDigest := &remoteexecution.Digest{Hash: fmt.Sprintf("%x", sha256.Sum256(file)), SizeBytes: int64(len(file))}
+		assert.NilError(t, blobs.WriteBlob(context.Background(), fileDigest.Hash, fileDigest.SizeBytes, bytes.NewReader(file)))
+
+		tree, err := proto.Marshal(&remoteexecution.Tree{
+			Root: &remoteexecution.Directory{Files: []*remoteexecution.FileNode{{Name: "file", Digest: fileDigest}}},
+		})
+		assert.NilError(t, err)
+		treeDigest := &remoteexecution.Digest{Hash: fmt.Sprintf("%x", sha256.Sum256(tree)), SizeBytes: int64(len(tree))}
+		assert.NilError(t, blobs.WriteBlob(context.Background(), treeDigest.Hash, treeDigest.SizeBytes, bytes.NewReader(tree)))
+
+		dirAction := strings.Repeat("d", 64)
+		assert.NilError(t, blobs.UpdateActionResult(context.Background(), dirAction, &remoteexecution.ActionResult{
+			OutputDirectories: []*remoteexecution.OutputDirectory{{Path: "dir", TreeDigest: treeDigest}},
+		}))
+
+		assert.Equal(t, request("GET", "/ac/"+dirAction, nil).Code, http.StatusOK)
+		rr := request("GET", "/cas/"+treeDigest.Hash, nil)
+		assert.Equal(t, rr.Code, http.StatusOK)
+		assert.DeepEqual(t, rr.Body.Bytes(), tree)
+
+		rr = request("GET", "/cas/"+fileDigest.Hash, nil)
+		assert.Equal(t, rr.Code, http.StatusOK)
+		assert.DeepEqual(t, rr.Body.Bytes(), file)
+	})
+
+	t.Run("bad uploads", func(t *testing.T) {
+		assert.Equal(t, request("PUT", "/cas/"+strings.Repeat("e", 64), content).Code, http.StatusBadRequest)
+		assert.Equal(t, request("PUT", "/ac/"+action, []byte("not a proto")).Code, http.StatusBadRequest)
+		assert.Equal(t, request("PUT", "/ac/"+action, make([]byte, maxActionResultSize+1)).Code,
+			http.StatusRequestEntityTooLarge)
+	})
+
+	t.Run("bad credentials", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "/ac/"+action, nil)
+		assert.NilError(t, err)
+		req.SetBasicAuth("bazel", "bad")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		assert.Equal(t, rr.Code, http.StatusUnauthorized)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		r, _ := createHandler("")
+		req, err := http.NewRequest("GET", "/ac/"+action, nil)
+		assert.NilError(t, err)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		assert.Equal(t, rr.Code, http.StatusNotFound)
+	})
+}
+
+func TestBlobIndex(t *testing.T) {
+	x := blobIndex{limit: 2}
+	x.add(&remoteexecution.Digest{Hash: "a", SizeBytes: 1}, false)
+	x.add(&remoteexecution.Digest{Hash: "b", SizeBytes: 2}, true)
+
+	ref, ok := x.get("a")
+	assert.Assert(t, ok)
+	assert.Equal(t, ref.size, int64(1))
+
+	// b is the least recently used
+	x.add(&remoteexecution.Digest{Hash: "c", SizeBytes: 3}, false)
+	_, ok = x.get("b")
+	assert.Assert(t, !ok)
+	_, ok = x.get("a")
+	assert.Assert(t, ok)
+	_, ok = x.get("c")
+	assert.Assert(t, ok)
+}
+
+func TestParseMode(t *testing.T) {
+	m, err := ParseMode("read-only")
+	assert.NilError(t, err)
+	assert.Equal(t, m, ModeReadOnly)
+
+	_, err = ParseMode("readonly")
+	assert.ErrorContains(t, err, `unknown mode "readonly"`)
+}
+
+func TestMetrics(t *testing.T) {
+	r, _ := createHandler("")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			key := fmt.Sprintf("key%d", i)
+			r.ServeHTTP(httptest.NewRecorder(), createBaseUploadRequest(t, key, bytes.NewBufferString("DATA")))
+			r.ServeHTTP(httptest.NewRecorder(), createDownloadRequest(t, key))
+			r.ServeHTTP(httptest.NewRecorder(), createDownloadRequest(t, "missing"+key))
+		}(i)
+	}
+	wg.Wait()
+
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	assert.NilError(t, err)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	assert.Equal(t, rr.Code, http.StatusOK)
+	for _, line := range []string{
+		"# TYPE tbc_uploads_total counter",
+		"tbc_uploads_total 10",
+		"tbc_downloads_total 10",
+		"tbc_downloads_not_found_total 10",
+		"tbc_ul_bytes_total 40",
+		`tbc_requests_in_flight{operation="upload"} 0`,
+		`tbc_request_duration_seconds_count{operation="download"} 20`,
+		`tbc_request_duration_seconds_bucket{operation="upload",le="+Inf"} 10`,
+		`tbc_remote_requests_total{method="download",code="OK"} 10`,
+		`tbc_remote_requests_total{method="download",code="NotFound"} 10`,
+		`tbc_remote_requests_total{method="upload",code="OK"} 10`,
+	} {
+		assert.Assert(t, strings.Contains(rr.Body.String(), line+"\n"), "missing %q", line)
+	}
+	// downloads look the artifact up only once
+	assert.Assert(t, !strings.Contains(rr.Body.String(), `method="stat"`))
+}
+
 func TestBidirectional(t *testing.T) {
 	var (
 		cl      = client.NewInMemoryClient()
@@ -263,6 +1161,50 @@ func TestBidirectional(t *testing.T) {
 	})
 }
 
+// truncatingClient fails downloads halfway through if truncate is set.
+type truncatingClient struct {
+	*client.InMemoryClient
+	truncate bool
+}
+
+func (c *truncatingClient) StreamFile(ctx context.Context, key string, open client.OpenFunc) error {
+	if !c.truncate {
+		return c.InMemoryClient.StreamFile(ctx, key, open)
+	}
+
+	buf := new(bytes.Buffer)
+	info, err := c.InMemoryClient.StatFile(ctx, key)
+	if err != nil {
+		return err
+	}
+	if _, err = c.InMemoryClient.DownloadFile(ctx, key, buf); err != nil {
+		return err
+	}
+	w, err := open(info)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(buf.Bytes()[:buf.Len()/2]); err != nil {
+		return err
+	}
+	return errors.New("connection to the remote cache lost")
+}
+
+// uploadHookClient calls hook instead of uploading.
+type uploadHookClient struct {
+	*client.InMemoryClient
+	hook func(ctx context.Context) error
+}
+
+func (c *uploadHookClient) UploadFile(ctx context.Context, _, _ string, _ client.Metadata) error {
+	return c.hook(ctx)
+}
+
+func (c *uploadHookClient) UploadReader(ctx context.Context, _ string, r io.Reader, _ int64, _ string, _ client.Metadata) error {
+	_, _ = io.Copy(io.Discard, r)
+	return c.hook(ctx)
+}
+
 func createHandler(token string) (http.Handler, *Server) {
 	return createHandlerForClient(token, client.NewInMemoryClient())
 }
@@ -300,6 +1242,14 @@ func uploadFile(t *testing.T, cl client.Interface, key string, data []byte, md c
 	assert.NilError(t, err)
 }
 
+func signArtifact(signatureKey, hash, teamID string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(signatureKey))
+	mac.Write([]byte(hash))
+	mac.Write([]byte(teamID))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
 func randomBytes(t *testing.T, n int) []byte {
 	b := make([]byte, n)
 	_, err := rand.Read(b)
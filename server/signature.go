@@ -0,0 +1,94 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+)
+
+var errBadSignature = errors.New("artifact signature verification failed")
+
+// tagVerifier recomputes the x-artifact-tag of an artifact as it is written to it. The tag is an HMAC-SHA256
+// of the hash, the team id and the artifact body, see
+// https://turbo.build/repo/docs/core-concepts/remote-caching#artifact-integrity-and-authenticity-verification
+type tagVerifier struct {
+	mac      hash.Hash
+	expected []byte
+}
+
+// newTagVerifier returns errBadSignature if tag is empty or malformed.
+func newTagVerifier(signatureKey, hash, teamID, tag string) (*tagVerifier, error) {
+	expected, err := base64.StdEncoding.DecodeString(tag)
+	if tag == "" || err != nil {
+		return nil, errBadSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(signatureKey))
+	mac.Write([]byte(hash + teamID))
+
+	return &tagVerifier{mac: mac, expected: expected}, nil
+}
+
+func (v *tagVerifier) Write(p []byte) (int, error) {
+	return v.mac.Write(p)
+}
+
+func (v *tagVerifier) verify() error {
+	if !hmac.Equal(v.mac.Sum(nil), v.expected) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// verifyingReader passes the content of r through the tag verifier. Instead of io.EOF, it returns
+// errBadSignature if the tag does not match.
+type verifyingReader struct {
+	r  io.Reader
+	tv *tagVerifier
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	_, _ = v.tv.Write(p[:n])
+
+	if err == io.EOF {
+		if verr := v.tv.verify(); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+// holdbackWriter forwards everything but the last byte written to it until flush is called. This way, a client
+// never receives the complete artifact before its signature has been verified.
+type holdbackWriter struct {
+	w       io.Writer
+	pending []byte
+}
+
+func (h *holdbackWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	out := append(h.pending, p[:len(p)-1]...)
+	h.pending = []byte{p[len(p)-1]}
+	if len(out) == 0 {
+		// don't let an empty write commit the response
+		return len(p), nil
+	}
+
+	if _, err := h.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (h *holdbackWriter) flush() error {
+	_, err := h.w.Write(h.pending)
+	h.pending = nil
+	return err
+}
@@ -6,16 +6,47 @@ import (
 )
 
 // Stats holds statistics for server operation. Can be requested with Server.GetStatistics().
+// Every field is also exported as a tbc_<slog tag>_total counter on the /metrics endpoint.
 type Stats struct {
-	ErrorsCount           int `slog:"errors"`
-	UploadCount           int `slog:"uploads"`
-	ExistsYesCount        int `slog:"exists_yes"`
-	ExistsNoCount         int `slog:"exists_no"`
-	DownloadCount         int `slog:"downloads"`
-	DownloadNotFoundCount int `slog:"downloads_not_found"`
-
-	UploadedBytes   int64 `slog:"ul_bytes"`
-	DownloadedBytes int64 `slog:"dl_bytes"`
+	ErrorsCount           int `slog:"errors" help:"Errors encountered while serving requests."`
+	UploadCount           int `slog:"uploads" help:"Artifacts uploaded to the remote cache."`
+	ExistsYesCount        int `slog:"exists_yes" help:"Artifact lookups that found the artifact."`
+	ExistsNoCount         int `slog:"exists_no" help:"Artifact lookups that did not find the artifact."`
+	DownloadCount         int `slog:"downloads" help:"Artifacts downloaded from the remote cache."`
+	DownloadNotFoundCount int `slog:"downloads_not_found" help:"Downloads of artifacts missing from the remote cache."`
+	// Uploads and downloads rejected due to a bad x-artifact-tag
+	SignatureRejectedCount int `slog:"signature_rejected" help:"Uploads and downloads rejected due to a bad signature."`
+
+	UploadedBytes   int64 `slog:"ul_bytes" help:"Bytes uploaded to the remote cache."`
+	DownloadedBytes int64 `slog:"dl_bytes" help:"Bytes downloaded from the remote cache."`
+
+	// Cache events reported by turbo
+	LocalHitCount   int   `slog:"local_hits" help:"Hits in the turbo local cache."`
+	LocalMissCount  int   `slog:"local_misses" help:"Misses in the turbo local cache."`
+	RemoteHitCount  int   `slog:"remote_hits" help:"Hits in the remote cache reported by turbo."`
+	RemoteMissCount int   `slog:"remote_misses" help:"Misses in the remote cache reported by turbo."`
+	TimeSavedMs     int64 `slog:"time_saved_ms" help:"Task time saved by cache hits in all sessions, in milliseconds."`
+
+	// Operations not forwarded to the remote cache due to Options.Mode
+	SkippedUploadCount int `slog:"skipped_uploads" help:"Uploads discarded in read-only mode."`
+	SkippedLookupCount int `slog:"skipped_lookups" help:"Lookups and downloads reported as misses in write-only mode."`
+
+	// Background uploads, see Options.AsyncUploads
+	AsyncUploadFailedCount    int `slog:"async_upload_failures" help:"Background uploads that failed."`
+	AsyncUploadAbandonedCount int `slog:"async_uploads_abandoned" help:"Background uploads aborted by Flush."`
+
+	// Durable outbox, see Options.Outbox
+	OutboxedCount           int `slog:"outboxed" help:"Failed or unfinished uploads kept in the outbox."`
+	OutboxReplayedCount     int `slog:"outbox_replayed" help:"Outbox entries uploaded on replay."`
+	OutboxReplayFailedCount int `slog:"outbox_replay_failures" help:"Outbox entries that failed to upload on replay."`
+
+	// Uploads not stored due to Options.MaxUploadSize, MinUploadSize, and MinDuration
+	SkippedTooLargeCount int `slog:"skipped_too_large" help:"Uploads discarded for exceeding the maximum size."`
+	SkippedTooSmallCount int `slog:"skipped_too_small" help:"Uploads discarded for being below the minimum size."`
+	SkippedTooFastCount  int `slog:"skipped_too_fast" help:"Uploads discarded for tasks faster than the minimum duration."`
+
+	// Requests cut off by Server.Shutdown
+	AbandonedRequestCount int `slog:"requests_abandoned" help:"Requests still running when the server was shut down."`
 }
 
 // SlogArgs converts stats to an array than can be passed to slog logging functions.
@@ -40,3 +71,14 @@ func (st Stats) SlogArgs() (result []any) {
 	}
 	return
 }
+
+// add adds every field of delta to st.
+func (st *Stats) add(delta Stats) {
+	values := reflect.ValueOf(st).Elem()
+	deltas := reflect.ValueOf(delta)
+
+	for i := 0; i < values.NumField(); i++ {
+		f := values.Field(i)
+		f.SetInt(f.Int() + deltas.Field(i).Int())
+	}
+}
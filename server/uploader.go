@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/Southclaws/fault"
+	"github.com/Southclaws/fault/fctx"
+	"github.com/Southclaws/fault/fmsg"
+	"github.com/be9/tbc/client"
+)
+
+const (
+	defaultUploadWorkers   = 4
+	defaultUploadQueueSize = 64
+)
+
+// uploadJob is a spooled artifact waiting to be uploaded.
+type uploadJob struct {
+	key      string
+	path     string
+	size     int64
+	metadata client.Metadata
+	// If set, the artifact is kept in the outbox until it's uploaded. Otherwise, path is a temp file.
+	entry *client.OutboxEntry
+}
+
+// finish cleans up after the job. Artifacts that were not uploaded stay in the outbox.
+func (j uploadJob) finish(uploaded bool) {
+	switch {
+	case j.entry == nil:
+		_ = os.Remove(j.path)
+	case uploaded:
+		j.entry.Discard()
+	default:
+		j.entry.Release()
+	}
+}
+
+// uploader uploads artifacts in the background with a bounded pool of workers.
+type uploader struct {
+	s    *Server
+	jobs chan uploadJob
+}
+
+func newUploader(s *Server, workers, queueSize int) *uploader {
+	if workers <= 0 {
+		workers = defaultUploadWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = defaultUploadQueueSize
+	}
+
+	u := &uploader{
+		s:    s,
+		jobs: make(chan uploadJob, queueSize),
+	}
+	for i := 0; i < workers; i++ {
+		go u.work()
+	}
+	return u
+}
+
+// enqueue spools the content of r and queues it for upload. It blocks while the queue is full.
+func (u *uploader) enqueue(ctx context.Context, key string, r io.Reader, metadata client.Metadata) error {
+	job, err := u.spool(key, r, metadata)
+	if err != nil {
+		return fault.Wrap(err, fctx.With(ctx))
+	}
+
+	if !u.s.begin() {
+		job.finish(false)
+		u.failed(job, Stats{AsyncUploadAbandonedCount: 1})
+		return fault.Wrap(errFlushing, fctx.With(ctx))
+	}
+	select {
+	case u.jobs <- job:
+		return nil
+	case <-ctx.Done():
+		u.s.pending.Done()
+		job.finish(false)
+		return fault.Wrap(ctx.Err(), fmsg.With("upload queue is full"), fctx.With(ctx))
+	}
+}
+
+// spool saves the content of r to the outbox, if there is one, or to a temp file. The outbox entry is committed
+// right away, so that it survives a crash, but it stays locked until the job is finished.
+func (u *uploader) spool(key string, r io.Reader, metadata client.Metadata) (uploadJob, error) {
+	if outbox := u.s.opts.Outbox; outbox != nil {
+		entry, err := outbox.Create()
+		if err != nil {
+			return uploadJob{}, err
+		}
+		if _, err = io.Copy(entry, r); err == nil {
+			err = entry.Commit(key, metadata)
+		}
+		if err != nil {
+			entry.Discard()
+			return uploadJob{}, err
+		}
+		return uploadJob{key: key, path: entry.DataPath(), size: entry.Size(), metadata: metadata, entry: entry}, nil
+	}
+
+	f, err := os.CreateTemp("", "tbc-upload-*.tmp")
+	if err != nil {
+		return uploadJob{}, fault.Wrap(err, fmsg.With("error creating a temp file"))
+	}
+	size, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return uploadJob{}, fault.Wrap(err, fmsg.With("error spooling upload"))
+	}
+	return uploadJob{key: key, path: f.Name(), size: size, metadata: metadata}, nil
+}
+
+func (u *uploader) work() {
+	for job := range u.jobs {
+		u.upload(job)
+	}
+}
+
+func (u *uploader) upload(job uploadJob) {
+	uploaded := false
+	defer func() {
+		job.finish(uploaded)
+		u.s.pending.Done()
+	}()
+
+	ctx := u.s.background
+	if ctx.Err() != nil {
+		u.failed(job, Stats{AsyncUploadAbandonedCount: 1})
+		return
+	}
+
+	if err := u.s.cl.UploadFile(fctx.WithMeta(ctx, "key", job.key), job.key, job.path, job.metadata); err != nil {
+		if ctx.Err() != nil {
+			u.failed(job, Stats{AsyncUploadAbandonedCount: 1})
+			return
+		}
+		u.failed(job, Stats{AsyncUploadFailedCount: 1})
+		u.s.logError(err)
+		return
+	}
+
+	uploaded = true
+	u.s.record(Stats{UploadCount: 1, UploadedBytes: job.size})
+}
+
+// failed records delta for a job that was not uploaded, counting it as outboxed if it's kept in the outbox.
+func (u *uploader) failed(job uploadJob, delta Stats) {
+	if job.entry != nil {
+		delta.OutboxedCount = 1
+	}
+	u.s.record(delta)
+}